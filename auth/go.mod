@@ -10,3 +10,6 @@ require (
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
 	google.golang.org/grpc v1.27.0
 )
+
+// the validator is built from this repository, see Dockerfile
+replace github.com/ilya-pauzner/dc-store/validator => ../validator
@@ -0,0 +1,174 @@
+// +build !solution
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Uploads are kept in a blob store under the id of their job, see
+// csv-producer/blob.go. Every store an upload may be in is configured, so
+// that changing BLOB_STORE does not strand queued jobs.
+const (
+	blobLocal  = "local"
+	blobInline = "inline"
+	blobS3     = "s3"
+
+	defaultBlobDir = "/tmp/blobs"
+)
+
+// blobRef tells where an upload is, keep in sync with csv-producer.
+type blobRef struct {
+	Store string `json:"store"`
+	Key   string `json:"key,omitempty"`
+	// contents of inline blobs
+	Data []byte `json:"data,omitempty"`
+	Size int64  `json:"size"`
+	// SHA-256 of the contents in hex
+	Sha256 string `json:"sha256"`
+}
+
+type blobStore interface {
+	// Open reads a blob from offset on.
+	Open(key string, offset int64) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// errNoBlob means a blob is not in its store.
+var errNoBlob = errors.New("no such blob")
+
+var blobStores = map[string]blobStore{}
+
+// setupBlobStores configures the local store from BLOB_DIR, and the s3 one
+// if S3_ENDPOINT is set, as described in newS3Store.
+func setupBlobStores() error {
+	dir := os.Getenv("BLOB_DIR")
+	if dir == "" {
+		dir = defaultBlobDir
+	}
+	blobStores[blobLocal] = localStore{dir: dir}
+
+	if os.Getenv("S3_ENDPOINT") != "" {
+		s, err := newS3Store()
+		if err != nil {
+			return err
+		}
+		blobStores[blobS3] = s
+	}
+	return nil
+}
+
+// openBlob opens the upload ref points to, checking it against its
+// checksum as it is read.
+func openBlob(ref blobRef) (io.ReadCloser, error) {
+	var contents io.ReadCloser
+	if ref.Store == blobInline {
+		contents = ioutil.NopCloser(bytes.NewReader(ref.Data))
+	} else {
+		store, ok := blobStores[ref.Store]
+		if !ok {
+			return nil, fmt.Errorf("%w: blob store %s is not configured", errInvalidFile, ref.Store)
+		}
+
+		var err error
+		contents, err = store.Open(ref.Key, 0)
+		if errors.Is(err, errNoBlob) {
+			return nil, fmt.Errorf("%w: %s", errInvalidFile, err)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if ref.Sha256 == "" {
+		return contents, nil
+	}
+	return &checkedReader{ReadCloser: contents, hash: sha256.New(), sum: ref.Sha256}, nil
+}
+
+// openBlobAt opens the upload ref points to from offset on. Only the whole
+// of it is checked against its checksum, which the scan of a file does.
+func openBlobAt(ref blobRef, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return openBlob(ref)
+	}
+
+	if ref.Store == blobInline {
+		if offset > int64(len(ref.Data)) {
+			return nil, fmt.Errorf("%w: file is shorter than it was", errInvalidFile)
+		}
+		return ioutil.NopCloser(bytes.NewReader(ref.Data[offset:])), nil
+	}
+	store, ok := blobStores[ref.Store]
+	if !ok {
+		return nil, fmt.Errorf("%w: blob store %s is not configured", errInvalidFile, ref.Store)
+	}
+
+	contents, err := store.Open(ref.Key, offset)
+	if errors.Is(err, errNoBlob) {
+		return nil, fmt.Errorf("%w: %s", errInvalidFile, err)
+	}
+	return contents, err
+}
+
+func deleteBlob(ref blobRef) error {
+	store, ok := blobStores[ref.Store]
+	if !ok {
+		return nil
+	}
+	return store.Delete(ref.Key)
+}
+
+// checkedReader fails at the end of a blob if it does not match its
+// checksum, so that a damaged upload is never imported in full.
+type checkedReader struct {
+	io.ReadCloser
+	hash hash.Hash
+	sum  string
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	_, _ = c.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(c.hash.Sum(nil)) != c.sum {
+		return n, fmt.Errorf("%w: file does not match its checksum", errInvalidFile)
+	}
+	return n, err
+}
+
+// localStore reads blobs from a directory shared with csv-producer.
+type localStore struct {
+	dir string
+}
+
+func (s localStore) Open(key string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", errNoBlob, key)
+	} else if err != nil {
+		return nil, err
+	}
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s localStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
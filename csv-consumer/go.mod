@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/go-redis/redis/v7 v7.3.0
 	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
+	golang.org/x/text v0.3.2
 )
@@ -0,0 +1,1051 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"reflect"
+	"strconv"
+)
+
+// Import policies tell what happens to a file with bad rows. Strict imports
+// nothing from such a file: every row is checked before anything is
+// written, and whatever is written by a job which fails later on, say
+// because stocks have changed meanwhile, is rolled back. Lenient skips bad
+// rows and imports the rest.
+const (
+	policyStrict  = "strict"
+	policyLenient = "lenient"
+)
+
+// Import modes tell what happens to stocks which exist already. Insert-only
+// leaves them alone, upsert updates them and adds new ones, update-only
+// updates them and adds nothing. Replace-all is upsert which also deletes
+// every stock missing from the file.
+const (
+	modeInsertOnly = "insert-only"
+	modeUpsert     = "upsert"
+	modeUpdateOnly = "update-only"
+	modeReplaceAll = "replace-all"
+)
+
+const (
+	// how many times a message is tried before its job fails
+	maxImportAttempts = 5
+	maxTxRetries      = 10
+
+	// how many rows are written in a single transaction, and how many rows
+	// make a chunk, the unit of work consumers split a file into
+	importBatchSize = 1000
+	importChunkRows = 100000
+
+	// Every job has a hash of checkpoints of its chunks, along with how
+	// many of them are done, a set of codes seen in a file imported in
+	// replace-all mode and, for strict imports, a hash of stocks as they
+	// were before the job first wrote them, by code. They live next to the
+	// stocks, so that they are written in the same transactions as the
+	// stocks.
+	checkpointPrefix  = "import:checkpoint:"
+	importCodesPrefix = "import:codes:"
+	importUndoPrefix  = "import:undo:"
+	// versions strict imports have left stocks at, 0 for deleted ones, by
+	// code, so that rolling back leaves alone what was changed since
+	importWrittenPrefix = "import:written:"
+	// what rows applied so far by a dry run would have left behind, by
+	// code, since dry runs do not write stocks themselves
+	importDryRunPrefix = "import:dry-run:"
+	// set in the checkpoints of a job which is rolled back, so that
+	// nothing is written by it anymore
+	rollbackField = "rollback"
+
+	reasonExists    = "stock with this code already exists"
+	reasonMissing   = "no such stock"
+	reasonUnchanged = "stock is unchanged"
+	reasonReserved  = "quantity is less than units already reserved"
+	// stocks held by orders are not deleted, see store/inventory.go
+	reasonHeld = "units of the stock are reserved, it is not deleted"
+)
+
+// errInvalidFile marks errors which would happen again if the same file
+// was imported again.
+var errInvalidFile = errors.New("invalid file")
+
+// errRejected means some of the stocks applied at once can not be written,
+// so none of them are.
+var errRejected = errors.New("stocks are rejected")
+
+// errChunkTaken means another consumer imports the chunk, or the job is
+// over or rolled back already, so there is nothing left to do.
+var errChunkTaken = errors.New("chunk is imported elsewhere")
+
+// row is a parsed record along with where it came from. Stock is nil for
+// a record which failed to parse.
+type row struct {
+	Line  int
+	Code  string
+	Stock *Stock
+	Err   error
+	// which fields of Stock the record has
+	Columns rowColumns
+
+	// where the row starts, see rowReader
+	Offset     int64
+	LineBefore int
+}
+
+// importChunk is a part of a file any consumer may import on its own.
+type importChunk struct {
+	Index int `json:"index"`
+	// how many chunks the file has
+	Total  int     `json:"total"`
+	Offset int64   `json:"offset"`
+	Line   int     `json:"line"`
+	Rows   int     `json:"rows"`
+	Schema *schema `json:"schema"`
+	// how many bytes of the file come before its text, see chunkStart
+	Prefix int64 `json:"prefix"`
+}
+
+// checkpoint tells how many rows of a chunk are imported, and where the
+// rest of them start.
+type checkpoint struct {
+	Offset int64 `json:"offset"`
+	Line   int   `json:"line"`
+	Rows   int   `json:"rows"`
+}
+
+func failedEntry(r row) jobReportEntry {
+	return jobReportEntry{Line: r.Line, Code: r.Code, Outcome: rowFailed, Reason: r.Err.Error()}
+}
+
+// outcome tells what happened to a stock, see jobReportEntry.
+type outcome struct {
+	Outcome string
+	Reason  string
+	Action  string
+	Before  *Stock
+	After   *Stock
+}
+
+func (o outcome) entry(r row) jobReportEntry {
+	return jobReportEntry{
+		Line:    r.Line,
+		Code:    r.Code,
+		Outcome: o.Outcome,
+		Reason:  o.Reason,
+		Action:  o.Action,
+		Before:  o.Before,
+		After:   o.After,
+	}
+}
+
+func deletedEntries(codes []uint64, olds []*Stock) []jobReportEntry {
+	var entries []jobReportEntry
+	for i, old := range olds {
+		if old == nil {
+			continue
+		}
+		entry := jobReportEntry{
+			Code:    strconv.FormatUint(codes[i], 10),
+			Outcome: rowDeleted,
+			Action:  actionDelete,
+			Before:  old,
+		}
+		if old.Reserved > 0 {
+			entry.Outcome, entry.Reason = rowSkipped, reasonHeld
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// importer imports a single file, or a chunk of it.
+type importer struct {
+	message importMessage
+}
+
+func newImporter(message importMessage) (*importer, error) {
+	switch message.Mode {
+	case modeInsertOnly, modeUpsert, modeUpdateOnly, modeReplaceAll:
+	case "":
+		message.Mode = modeInsertOnly
+	default:
+		return nil, fmt.Errorf("%w: unknown mode %s", errInvalidFile, message.Mode)
+	}
+	switch message.Policy {
+	case policyStrict, policyLenient:
+	case "":
+		message.Policy = policyStrict
+	default:
+		return nil, fmt.Errorf("%w: unknown policy %s", errInvalidFile, message.Policy)
+	}
+
+	return &importer{message: message}, nil
+}
+
+// actor is who imported stocks are attributed to.
+func (i *importer) actor() string {
+	if i.message.Uploader == "" {
+		return importActor
+	}
+	return i.message.Uploader
+}
+
+func checkpointKey(jobId string) string {
+	return checkpointPrefix + jobId
+}
+
+// record adds entries to the job, a dry run reports all of them.
+func (i *importer) record(entries []jobReportEntry) error {
+	return recordRows(i.message.JobId, entries, i.message.DryRun)
+}
+
+// scanFile is the first step of an import: it splits the file into chunks
+// and queues them. Strict imports check every row here as well.
+func scanFile(message importMessage) error {
+	i, err := newImporter(message)
+	if err != nil {
+		return err
+	}
+
+	f, err := openBlob(message.Blob)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	reader, err := newRowReader(f, message.Format)
+	if err != nil {
+		return err
+	}
+
+	var chunks []importChunk
+	var batch []row
+	bad := 0
+	check := func() error {
+		failed, err := i.check(batch)
+		if err != nil {
+			return err
+		}
+		batch = batch[:0]
+		bad += len(failed)
+		return i.record(failed)
+	}
+
+	rows := 0
+	err = reader.each(func(r row) error {
+		if rows%importChunkRows == 0 {
+			chunks = append(chunks, importChunk{Index: len(chunks), Offset: r.Offset, Line: r.LineBefore, Schema: reader.schema, Prefix: reader.prefix})
+		}
+		chunks[len(chunks)-1].Rows++
+		rows++
+
+		if i.message.Policy != policyStrict {
+			return nil
+		}
+		batch = append(batch, r)
+		if len(batch) == importBatchSize {
+			return check()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = check()
+	}
+	if err != nil {
+		return err
+	}
+
+	if bad > 0 {
+		return fmt.Errorf("%w: %d rows are bad or can not be applied, nothing is imported", errInvalidFile, bad)
+	}
+
+	err = i.startChunks(rows, chunks)
+	if err != nil {
+		return err
+	}
+	if len(chunks) == 0 {
+		return i.finalize()
+	}
+
+	for _, chunk := range chunks {
+		chunk.Total = len(chunks)
+		chunkMessage := i.message
+		chunkMessage.Chunk = &chunk
+		chunkMessage.Attempts = 0
+
+		body, err := json.Marshal(chunkMessage)
+		if err != nil {
+			return err
+		}
+		err = sendMessageToQueue(body)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check tells which rows of batch are bad or would be rejected if they
+// were applied now.
+func (i *importer) check(batch []row) ([]jobReportEntry, error) {
+	var failed []jobReportEntry
+	var good []row
+	var keys []string
+	for _, r := range batch {
+		if r.Err != nil {
+			failed = append(failed, failedEntry(r))
+			continue
+		}
+		good = append(good, r)
+		keys = append(keys, strconv.FormatUint(r.Stock.Code, 10))
+	}
+
+	olds, err := getStocks(stockClient, keys)
+	if err != nil {
+		return nil, err
+	}
+	for j, r := range good {
+		_, o := planStock(i.message.Mode, olds[j], r.Stock, r.Columns)
+		if o.Outcome == rowFailed {
+			failed = append(failed, o.entry(r))
+		}
+	}
+	return failed, nil
+}
+
+// startChunks records how big the file is and where its chunks start.
+// Checkpoints which exist already are kept, in case the file is scanned
+// again after its chunks were queued.
+func (i *importer) startChunks(rows int, chunks []importChunk) error {
+	key := checkpointKey(i.message.JobId)
+	_, err := stockClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, chunk := range chunks {
+			contents, err := json.Marshal(checkpoint{Offset: chunk.Offset, Line: chunk.Line})
+			if err != nil {
+				return err
+			}
+			pipe.HSetNX(key, strconv.Itoa(chunk.Index), contents)
+		}
+		pipe.HSetNX(key, "done", 0)
+		pipe.Expire(key, jobRetention)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return setJobSize(i.message.JobId, rows, len(chunks))
+}
+
+// checkpointUpdate moves the checkpoint of a chunk along with a batch of
+// its rows. Codes are those of the batch, remembered for replace-all.
+type checkpointUpdate struct {
+	Chunk *importChunk
+	From  checkpoint
+	To    checkpoint
+	Codes []string
+
+	// how many chunks are done after the update, if it finishes the chunk
+	done *redis.IntCmd
+}
+
+// processChunk imports a chunk from its checkpoint on, a batch at a time.
+// The last chunk to be done finishes the job.
+func processChunk(message importMessage) error {
+	i, err := newImporter(message)
+	if err != nil {
+		return err
+	}
+	chunk := message.Chunk
+
+	state, err := getJobState(message.JobId)
+	if err != nil {
+		return err
+	}
+	if state != jobRunning {
+		return errChunkTaken
+	}
+
+	from, err := i.getCheckpoint()
+	if err != nil {
+		return err
+	}
+	if from.Rows >= chunk.Rows {
+		return i.finalizeIfDone(nil)
+	}
+
+	// files are not read from the start for every chunk where possible
+	start, seeked := chunkStart(message.Format, chunk.Prefix, from.Offset)
+	f, err := openBlobAt(message.Blob, start)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	reader, err := newChunkReader(f, message.Format, chunk.Schema, from.Offset, from.Line, chunk.Rows-from.Rows, seeked)
+	if err != nil {
+		return err
+	}
+
+	var update *checkpointUpdate
+	var batch []row
+	flush := func() error {
+		offset, line := reader.position()
+		update = &checkpointUpdate{
+			Chunk: chunk,
+			From:  from,
+			To:    checkpoint{Offset: offset, Line: line, Rows: from.Rows + len(batch)},
+		}
+		err := i.applyBatch(batch, update)
+		if err != nil {
+			return err
+		}
+		from, batch = update.To, batch[:0]
+
+		// someone may have failed the job meanwhile
+		state, err := getJobState(message.JobId)
+		if err != nil {
+			return err
+		}
+		if state != jobRunning {
+			return errChunkTaken
+		}
+		return nil
+	}
+
+	err = reader.each(func(r row) error {
+		batch = append(batch, r)
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	if from.Rows < chunk.Rows {
+		return fmt.Errorf("%w: file is shorter than it was", errInvalidFile)
+	}
+	return i.finalizeIfDone(update.done)
+}
+
+func (i *importer) getCheckpoint() (checkpoint, error) {
+	var cp checkpoint
+	contents, err := stockClient.HGet(checkpointKey(i.message.JobId), strconv.Itoa(i.message.Chunk.Index)).Result()
+	if errors.Is(err, redis.Nil) {
+		// the job is over and forgotten
+		return cp, errChunkTaken
+	} else if err != nil {
+		return cp, err
+	}
+
+	err = json.Unmarshal([]byte(contents), &cp)
+	return cp, err
+}
+
+// applyBatch applies good rows of batch and reports all of them. Lenient
+// imports leave out rows which are rejected and apply the rest.
+func (i *importer) applyBatch(batch []row, update *checkpointUpdate) error {
+	var entries []jobReportEntry
+	var rows []row
+	for _, r := range batch {
+		if r.Err != nil {
+			entries = append(entries, failedEntry(r))
+			continue
+		}
+		rows = append(rows, r)
+		if i.message.Mode == modeReplaceAll {
+			update.Codes = append(update.Codes, strconv.FormatUint(r.Stock.Code, 10))
+		}
+	}
+
+	for {
+		outcomes, err := i.apply(rows, update)
+		if err != nil && !errors.Is(err, errRejected) {
+			return err
+		}
+
+		var keptRows []row
+		for j, o := range outcomes {
+			if err == nil || o.Outcome == rowFailed {
+				entries = append(entries, o.entry(rows[j]))
+			} else {
+				keptRows = append(keptRows, rows[j])
+			}
+		}
+		if err == nil {
+			break
+		}
+
+		if i.message.Policy == policyStrict {
+			// rows were fine when they were checked, but stocks have
+			// changed since, what is written already is rolled back
+			recordErr := i.record(entries)
+			if recordErr != nil {
+				return recordErr
+			}
+			return fmt.Errorf("%w: rows can not be applied anymore", errInvalidFile)
+		}
+		rows = keptRows
+	}
+	return i.record(entries)
+}
+
+// finalizeIfDone finishes the job if every chunk is done. done is how many
+// are, if known.
+func (i *importer) finalizeIfDone(done *redis.IntCmd) error {
+	var count int64
+	var err error
+	if done != nil {
+		count = done.Val()
+	} else {
+		count, err = stockClient.HGet(checkpointKey(i.message.JobId), "done").Int64()
+		if err != nil {
+			return err
+		}
+	}
+
+	if count < int64(i.message.Chunk.Total) {
+		return nil
+	}
+	return i.finalize()
+}
+
+// finalize deletes stocks missing from a file imported in replace-all mode
+// and finishes the job.
+func (i *importer) finalize() error {
+	// only one consumer finishes a job
+	key := checkpointKey(i.message.JobId)
+	ok, err := stockClient.HSetNX(key, "finalizing", 1).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	err = i.deleteMissing()
+	if err != nil && !errors.Is(err, errInvalidFile) {
+		// let whoever retries finalize it
+		_ = stockClient.HDel(key, "finalizing").Err()
+		return err
+	}
+	dropImport(i.message)
+	return finishImport(i.message, err)
+}
+
+// planStock decides what to write in place of old when stock is imported
+// in mode, returning nil if nothing should be written. Fields the file has
+// no columns for are kept from old.
+func planStock(mode string, old *Stock, stock *Stock, columns rowColumns) (*Stock, outcome) {
+	if old == nil {
+		if mode == modeUpdateOnly {
+			return nil, outcome{Outcome: rowSkipped, Reason: reasonMissing}
+		}
+		return stock, outcome{Outcome: rowWritten, Action: actionCreate, After: stock}
+	}
+	if mode == modeInsertOnly {
+		return nil, outcome{Outcome: rowSkipped, Reason: reasonExists, Before: old}
+	}
+
+	// files know nothing about reservations, they are kept as they are
+	updated := *stock
+	if !columns.Name {
+		updated.Name = old.Name
+	}
+	if !columns.Categories {
+		updated.Categories = old.Categories
+	}
+	if !columns.Quantity {
+		updated.Quantity = old.Quantity
+	}
+	if !columns.Price {
+		updated.Price = old.Price
+	}
+	updated.Reserved = old.Reserved
+	updated.Version = old.Version
+	if updated.Quantity < updated.Reserved {
+		return nil, outcome{Outcome: rowFailed, Reason: reasonReserved, Before: old}
+	}
+	if reflect.DeepEqual(old, &updated) {
+		return nil, outcome{Outcome: rowSkipped, Reason: reasonUnchanged, Before: old}
+	}
+	return &updated, outcome{Outcome: rowWritten, Action: actionUpdate, Before: old, After: &updated}
+}
+
+// apply atomically applies stocks along with a checkpoint update, telling
+// what happened to each of them. If any of them fails, nothing is written
+// and errRejected is returned. If the checkpoint has moved meanwhile,
+// errChunkTaken is. Dry runs only tell what would happen, moving the
+// checkpoint all the same.
+func (i *importer) apply(rows []row, update *checkpointUpdate) ([]outcome, error) {
+	key := checkpointKey(i.message.JobId)
+	field := strconv.Itoa(update.Chunk.Index)
+	from, err := json.Marshal(update.From)
+	if err != nil {
+		return nil, err
+	}
+	to, err := json.Marshal(update.To)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(rows))
+	for j, r := range rows {
+		keys[j] = strconv.FormatUint(r.Stock.Code, 10)
+	}
+
+	dryRunKey := importDryRunPrefix + i.message.JobId
+	var outcomes []outcome
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.HGet(key, field).Result()
+		if errors.Is(err, redis.Nil) || err == nil && current != string(from) {
+			return errChunkTaken
+		} else if err != nil {
+			return err
+		}
+		err = checkNotRolledBack(tx, key)
+		if err != nil {
+			return err
+		}
+
+		olds, err := getStocks(tx, keys)
+		if err != nil {
+			return err
+		}
+		if i.message.DryRun {
+			err = getDryRunStocks(tx, dryRunKey, keys, olds)
+			if err != nil {
+				return err
+			}
+		}
+		// stocks created again follow versions of deleted ones
+		previous, err := getPrevious(tx, keys, olds)
+		if err != nil {
+			return err
+		}
+
+		// a code may appear several times, every time the previous row is
+		// what gets replaced
+		applied := make(map[uint64]*Stock)
+		writes := make([]*Stock, len(rows))
+		outcomes = make([]outcome, len(rows))
+		rejected := false
+		for j, r := range rows {
+			stock := r.Stock
+			if old, ok := applied[stock.Code]; ok {
+				olds[j] = old
+			}
+			if olds[j] != nil {
+				previous[j] = olds[j]
+			}
+
+			writes[j], outcomes[j] = planStock(i.message.Mode, olds[j], stock, r.Columns)
+			if outcomes[j].Outcome == rowFailed {
+				rejected = true
+			}
+			if writes[j] != nil {
+				applied[stock.Code] = writes[j]
+			} else {
+				applied[stock.Code] = olds[j]
+			}
+		}
+		if rejected {
+			return errRejected
+		}
+
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			for j, r := range rows {
+				if writes[j] == nil {
+					continue
+				}
+				if i.message.DryRun {
+					contents, err := json.Marshal(writes[j])
+					if err != nil {
+						return err
+					}
+					pipe.HSet(dryRunKey, keys[j], contents)
+					pipe.Expire(dryRunKey, jobRetention)
+					continue
+				}
+				err := writeStockAfter(pipe, r.Stock.Code, olds[j], previous[j], writes[j], i.actor())
+				if err != nil {
+					return err
+				}
+				err = i.keepUndo(pipe, keys[j], olds[j], writes[j])
+				if err != nil {
+					return err
+				}
+			}
+
+			pipe.HSet(key, field, to)
+			if len(update.Codes) > 0 {
+				codesKey := importCodesPrefix + i.message.JobId
+				pipe.SAdd(codesKey, update.Codes)
+				pipe.Expire(codesKey, jobRetention)
+			}
+			if update.To.Rows >= update.Chunk.Rows {
+				update.done = pipe.HIncrBy(key, "done", 1)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for j := 0; j < maxTxRetries; j++ {
+		err := stockClient.Watch(txf, append(keys, key, dryRunKey)...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return outcomes, err
+	}
+	return nil, redis.TxFailedErr
+}
+
+// getDryRunStocks replaces olds under keys with what a dry run has left
+// them at so far, if it has written them.
+func getDryRunStocks(tx *redis.Tx, dryRunKey string, keys []string, olds []*Stock) error {
+	values, err := tx.HMGet(dryRunKey, keys...).Result()
+	if err != nil {
+		return err
+	}
+	for j, value := range values {
+		contents, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var stock Stock
+		err = json.Unmarshal([]byte(contents), &stock)
+		if err != nil {
+			return err
+		}
+		olds[j] = &stock
+	}
+	return nil
+}
+
+// deleteMissing deletes stocks missing from a file imported in replace-all
+// mode, a batch at a time. Nothing is deleted if the file had bad rows, so
+// that a broken file does not wipe the catalog out.
+func (i *importer) deleteMissing() error {
+	if i.message.Mode != modeReplaceAll {
+		return nil
+	}
+
+	failed, err := getJobFailed(i.message.JobId)
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%w: %d rows are bad, missing stocks are not deleted", errInvalidFile, failed)
+	}
+
+	codesKey := importCodesPrefix + i.message.JobId
+	min := "-"
+	for {
+		members, err := stockClient.ZRangeByLex(stocksIndexKey, &redis.ZRangeBy{
+			Min:   min,
+			Max:   "+",
+			Count: importBatchSize,
+		}).Result()
+		if err != nil || len(members) == 0 {
+			return err
+		}
+		min = "(" + members[len(members)-1]
+
+		codes := make([]uint64, len(members))
+		found := make([]*redis.BoolCmd, len(members))
+		_, err = stockClient.Pipelined(func(pipe redis.Pipeliner) error {
+			for j, member := range members {
+				codes[j], err = strconv.ParseUint(member, 10, 64)
+				if err != nil {
+					return err
+				}
+				found[j] = pipe.SIsMember(codesKey, strconv.FormatUint(codes[j], 10))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		var missing []uint64
+		for j, code := range codes {
+			if !found[j].Val() {
+				missing = append(missing, code)
+			}
+		}
+
+		entries, err := i.deleteStocks(missing)
+		if err != nil {
+			return err
+		}
+		err = i.record(entries)
+		if err != nil {
+			return err
+		}
+
+		if len(members) < importBatchSize {
+			return nil
+		}
+	}
+}
+
+func (i *importer) deleteStocks(codes []uint64) ([]jobReportEntry, error) {
+	if len(codes) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(codes))
+	for j, code := range codes {
+		keys[j] = strconv.FormatUint(code, 10)
+	}
+
+	key := checkpointKey(i.message.JobId)
+	var entries []jobReportEntry
+	txf := func(tx *redis.Tx) error {
+		err := checkNotRolledBack(tx, key)
+		if err != nil {
+			return err
+		}
+		olds, err := getStocks(tx, keys)
+		if err != nil {
+			return err
+		}
+
+		entries = deletedEntries(codes, olds)
+		if i.message.DryRun {
+			return nil
+		}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			for j, old := range olds {
+				if old == nil || old.Reserved > 0 {
+					continue
+				}
+				err := writeStock(pipe, codes[j], old, nil, i.actor())
+				if err != nil {
+					return err
+				}
+				err = i.keepUndo(pipe, keys[j], old, nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	for j := 0; j < maxTxRetries; j++ {
+		err := stockClient.Watch(txf, append(keys, key)...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return entries, err
+	}
+	return nil, redis.TxFailedErr
+}
+
+// rollBackImport rolls back a strict import which has failed with
+// importErr, adding to it how that went.
+func rollBackImport(message importMessage, importErr error) error {
+	i, err := newImporter(message)
+	if err != nil || i.message.Policy != policyStrict || i.message.DryRun {
+		return importErr
+	}
+
+	counts, err := i.rollBack()
+	if err != nil {
+		return fmt.Errorf("%w, rolling back what is written failed: %s", importErr, err)
+	}
+	if counts.Held > 0 {
+		importErr = fmt.Errorf("%w, %d stocks written are kept since units of them are reserved", importErr, counts.Held)
+	}
+	if counts.Changed > 0 {
+		importErr = fmt.Errorf("%w, %d stocks written are kept since they were changed by others", importErr, counts.Changed)
+	}
+	return importErr
+}
+
+func checkNotRolledBack(tx *redis.Tx, key string) error {
+	rolledBack, err := tx.HExists(key, rollbackField).Result()
+	if err != nil {
+		return err
+	}
+	if rolledBack {
+		return errChunkTaken
+	}
+	return nil
+}
+
+// keepUndo queues commands remembering old as what the stock under key
+// was before the job, unless the job has written it already, and written
+// as what the job has left it at. Only strict imports are ever rolled back.
+func (i *importer) keepUndo(pipe redis.Pipeliner, key string, old *Stock, written *Stock) error {
+	if i.message.Policy != policyStrict {
+		return nil
+	}
+	contents, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	var version uint64
+	if written != nil {
+		version = written.Version
+	}
+
+	undoKey := importUndoPrefix + i.message.JobId
+	writtenKey := importWrittenPrefix + i.message.JobId
+	pipe.HSetNX(undoKey, key, contents)
+	pipe.HSet(writtenKey, key, version)
+	pipe.Expire(undoKey, jobRetention)
+	pipe.Expire(writtenKey, jobRetention)
+	return nil
+}
+
+// rollbackCounts tells how many stocks written by a job are not rolled back
+// since units of them are reserved meanwhile, and since someone else has
+// changed them meanwhile.
+type rollbackCounts struct {
+	Held    int
+	Changed int
+}
+
+func (c *rollbackCounts) add(other rollbackCounts) {
+	c.Held += other.Held
+	c.Changed += other.Changed
+}
+
+// rollBack stops the job from writing anything else and puts back stocks
+// it has written as they were before, unless they are changed since.
+func (i *importer) rollBack() (rollbackCounts, error) {
+	var counts rollbackCounts
+	key := checkpointKey(i.message.JobId)
+	_, err := stockClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, rollbackField, 1)
+		pipe.Expire(key, jobRetention)
+		return nil
+	})
+	if err != nil {
+		return counts, err
+	}
+
+	undoKey := importUndoPrefix + i.message.JobId
+	writtenKey := importWrittenPrefix + i.message.JobId
+	var cursor uint64
+	for {
+		fields, next, err := stockClient.HScan(undoKey, cursor, "", importBatchSize).Result()
+		if err != nil {
+			return counts, err
+		}
+
+		var keys []string
+		var befores []*Stock
+		for j := 0; j+1 < len(fields); j += 2 {
+			var before *Stock
+			err = json.Unmarshal([]byte(fields[j+1]), &before)
+			if err != nil {
+				return counts, err
+			}
+			keys = append(keys, fields[j])
+			befores = append(befores, before)
+		}
+		batchCounts, err := i.restoreStocks(keys, befores)
+		counts.add(batchCounts)
+		if err != nil {
+			return counts, err
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+	return counts, stockClient.Del(undoKey, writtenKey).Err()
+}
+
+// restoreStocks puts back stocks under keys as befores, unless they are no
+// longer what the job has left them at, or units of them are reserved
+// beyond what befores have.
+func (i *importer) restoreStocks(keys []string, befores []*Stock) (rollbackCounts, error) {
+	var counts rollbackCounts
+	if len(keys) == 0 {
+		return counts, nil
+	}
+
+	versions, err := stockClient.HMGet(importWrittenPrefix+i.message.JobId, keys...).Result()
+	if err != nil {
+		return counts, err
+	}
+
+	txf := func(tx *redis.Tx) error {
+		currents, err := getStocks(tx, keys)
+		if err != nil {
+			return err
+		}
+		previous, err := getPrevious(tx, keys, currents)
+		if err != nil {
+			return err
+		}
+
+		counts = rollbackCounts{}
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			for j, current := range currents {
+				code, err := strconv.ParseUint(keys[j], 10, 64)
+				if err != nil {
+					return err
+				}
+
+				version, _ := versions[j].(string)
+				var currentVersion uint64
+				if current != nil {
+					currentVersion = current.Version
+				}
+				if version != strconv.FormatUint(currentVersion, 10) {
+					counts.Changed++
+					continue
+				}
+
+				var restored *Stock
+				if before := befores[j]; before != nil {
+					stock := *before
+					if current != nil {
+						stock.Reserved = current.Reserved
+						stock.Version = current.Version
+					}
+					restored = &stock
+				}
+				if current != nil && current.Reserved > 0 && (restored == nil || restored.Quantity < restored.Reserved) {
+					counts.Held++
+					continue
+				}
+				if reflect.DeepEqual(current, restored) {
+					continue
+				}
+
+				err = writeStockAfter(pipe, code, current, previous[j], restored, i.actor())
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	for j := 0; j < maxTxRetries; j++ {
+		err := stockClient.Watch(txf, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return counts, err
+	}
+	return rollbackCounts{}, redis.TxFailedErr
+}
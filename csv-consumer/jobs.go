@@ -0,0 +1,184 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"strconv"
+	"time"
+)
+
+// Jobs are created by csv-producer, see csv-producer/jobs.go for the
+// layout. Only the consumer moves them past queued.
+const (
+	jobPrefix       = "job:"
+	jobReportPrefix = "job-report:"
+
+	// keep in sync with csv-producer
+	jobRetention = 7 * 24 * time.Hour
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// outcomes of a row, named after counters of a job, and of a stock
+// missing from a file imported in replace-all mode
+const (
+	rowWritten = "written"
+	rowSkipped = "skipped"
+	rowFailed  = "failed"
+	rowDeleted = "deleted"
+)
+
+// what writing a stock does to it
+const (
+	actionCreate = "create"
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// jobReportEntry describes the outcome of a row. Only those which were not
+// written are kept in the report, except for dry runs, which keep all of
+// them along with the stocks before and after.
+type jobReportEntry struct {
+	Line    int    `json:"line,omitempty"`
+	Code    string `json:"code"`
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason,omitempty"`
+	Action  string `json:"action,omitempty"`
+	Before  *Stock `json:"before,omitempty"`
+	After   *Stock `json:"after,omitempty"`
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// startJob marks a job running, forgetting about previous attempts.
+func startJob(id string) error {
+	_, err := jobsClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(jobPrefix+id,
+			"state", jobRunning,
+			"rows", 0,
+			rowWritten, 0,
+			rowSkipped, 0,
+			rowFailed, 0,
+			rowDeleted, 0,
+			"total", 0,
+			"chunks", 0,
+			"error", "",
+			"updated_at", now(),
+		)
+		pipe.Del(jobReportPrefix + id)
+		return nil
+	})
+	return err
+}
+
+// setJobSize records how many rows a file has, and how many chunks they
+// are split into.
+func setJobSize(id string, rows int, chunks int) error {
+	return jobsClient.HSet(jobPrefix+id,
+		"total", rows,
+		"chunks", chunks,
+		"updated_at", now(),
+	).Err()
+}
+
+func getJobState(id string) (string, error) {
+	return jobsClient.HGet(jobPrefix+id, "state").Result()
+}
+
+// getJobFailed tells how many rows of a job have failed so far.
+func getJobFailed(id string) (int64, error) {
+	return jobsClient.HGet(jobPrefix+id, rowFailed).Int64()
+}
+
+// recordRows counts outcomes of rows, adding those which were not written
+// to the report, or all of them if full is set.
+func recordRows(id string, entries []jobReportEntry, full bool) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	_, err := jobsClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			// stocks missing from a file are not its rows
+			if entry.Action != actionDelete {
+				pipe.HIncrBy(jobPrefix+id, "rows", 1)
+			}
+			pipe.HIncrBy(jobPrefix+id, entry.Outcome, 1)
+			if !full {
+				if entry.Outcome == rowWritten || entry.Outcome == rowDeleted {
+					continue
+				}
+				// only dry runs tell what stocks were like
+				entry.Before, entry.After = nil, nil
+			}
+
+			contents, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			pipe.RPush(jobReportPrefix+id, contents)
+		}
+		pipe.Expire(jobReportPrefix+id, jobRetention)
+		pipe.HSet(jobPrefix+id, "updated_at", now())
+		return nil
+	})
+	return err
+}
+
+// requeueJob marks a job queued again after an attempt failed with err.
+func requeueJob(id string, attempt int, err error) error {
+	return jobsClient.HSet(jobPrefix+id,
+		"state", jobQueued,
+		"error", "attempt "+strconv.Itoa(attempt)+" failed: "+err.Error(),
+		"updated_at", now(),
+	).Err()
+}
+
+// finishJob marks a job failed with err, or succeeded if it is nil, unless
+// it is finished already, so that the first chunk to fail tells why.
+func finishJob(id string, err error) error {
+	state, message := jobSucceeded, ""
+	if err != nil {
+		state, message = jobFailed, err.Error()
+	}
+
+	key := jobPrefix + id
+	txf := func(tx *redis.Tx) error {
+		current, err := tx.HGet(key, "state").Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if current == jobSucceeded || current == jobFailed {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key,
+				"state", state,
+				"error", message,
+				"updated_at", now(),
+			)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxTxRetries; i++ {
+		err := jobsClient.Watch(txf, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return err
+	}
+	return redis.TxFailedErr
+}
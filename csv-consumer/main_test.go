@@ -0,0 +1,79 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// categoryCase is a list of categories along with how store exports it,
+// see TestJoinCategories in store.
+type categoryCase struct {
+	Categories []string `json:"categories"`
+	Joined     string   `json:"joined"`
+}
+
+func readCategoryCases(t *testing.T, path string) []categoryCase {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []categoryCase
+	err = json.Unmarshal(contents, &cases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cases
+}
+
+func TestSplitCategories(t *testing.T) {
+	for _, c := range readCategoryCases(t, "../store/testdata/categories.json") {
+		// parseRecord takes an empty column for no categories
+		if c.Joined == "" {
+			continue
+		}
+		if categories := splitCategories(c.Joined, defaultCategorySeparator); !reflect.DeepEqual(categories, c.Categories) {
+			t.Errorf("splitCategories(%q) = %q, should be %q", c.Joined, categories, c.Categories)
+		}
+	}
+}
+
+func TestParseExportedRecords(t *testing.T) {
+	// exported by TestCsvExport in store
+	f, err := os.Open("../store/testdata/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*Stock{
+		{Code: 1, Name: "Carrot", Categories: []string{"food", "vegetable"}, Quantity: 3, Price: &Price{Amount: 1234, Currency: "USD"}, Version: 1},
+		{Code: 2, Name: `Salt, "fine"`, Categories: []string{"salt & pepper", `back\slash`, `ends with \`}, Version: 1},
+		{Code: 3, Name: "Nothing", Categories: []string{}, Quantity: 7, Price: &Price{Amount: 500, Currency: "JPY"}, Version: 1},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("export has %d records, should have %d", len(records), len(expected))
+	}
+
+	s := positionalSchema(defaultCategorySeparator)
+	for i, record := range records {
+		stock, err := parseRecord(record, s)
+		if err != nil {
+			t.Errorf("record %q: %s", record, err)
+			continue
+		}
+		if !reflect.DeepEqual(stock, expected[i]) {
+			t.Errorf("record %q is imported as %+v, should be %+v", record, stock, expected[i])
+		}
+	}
+}
@@ -0,0 +1,101 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// per-stock lists of past prices kept by store, see store/price.go
+const (
+	priceHistoryPrefix = "history:price:"
+	maxPriceHistory    = 1000
+)
+
+// Price is an exact amount of money in minor units of Currency, e.g. cents
+// for USD. Currency is an ISO 4217 alphabetic code.
+type Price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type priceChange struct {
+	Price     *Price    `json:"price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// currencies with other than two digits after the decimal point
+var currencyExponents = map[string]int{
+	"BHD": 3, "BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "IQD": 3, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KMF": 0, "KRW": 0, "KWD": 3, "LYD": 3, "OMR": 3,
+	"PYG": 0, "RWF": 0, "TND": 3, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+var (
+	priceRegexp    = regexp.MustCompile(`^([0-9]+)(?:\.([0-9]+))? ([A-Z]{3})$`)
+	errPriceFormat = errors.New("price should look like 12.34 USD")
+)
+
+// parsePrice parses a decimal amount followed by a currency code without
+// going through floating point, so the result is exact.
+func parsePrice(s string) (*Price, error) {
+	match := priceRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return nil, errPriceFormat
+	}
+	whole, fraction, currency := match[1], match[2], match[3]
+
+	exponent, ok := currencyExponents[currency]
+	if !ok {
+		exponent = 2
+	}
+	if len(fraction) > exponent {
+		return nil, errors.New("too many digits after the decimal point for " + currency)
+	}
+	fraction += strings.Repeat("0", exponent-len(fraction))
+
+	amount, err := strconv.ParseInt(whole+fraction, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &Price{Amount: amount, Currency: currency}, nil
+}
+
+// recordPrice queues commands remembering the price of stock if it differs
+// from the one of old, just as store does.
+func recordPrice(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock) error {
+	if stock == nil {
+		return nil
+	}
+
+	var oldPrice *Price
+	if old != nil {
+		oldPrice = old.Price
+	}
+	if samePrice(oldPrice, stock.Price) {
+		return nil
+	}
+
+	contents, err := json.Marshal(priceChange{Price: stock.Price, ChangedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	key := priceHistoryPrefix + strconv.FormatUint(code, 10)
+	pipe.LPush(key, contents)
+	pipe.LTrim(key, 0, maxPriceHistory-1)
+	return nil
+}
+
+func samePrice(a *Price, b *Price) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,161 @@
+// +build !solution
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	// SHA-256 of nothing, the payload of requests without a body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3Store keeps blobs in a bucket of an S3-compatible service, such as
+// MinIO. Buckets are addressed by path, so no DNS is needed for them.
+// csv-producer/s3.go writes them, keep in sync.
+type s3Store struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Store is configured by S3_ENDPOINT (e.g. http://minio:9000),
+// S3_BUCKET, S3_REGION, S3_ACCESS_KEY and S3_SECRET_KEY.
+func newS3Store() (*s3Store, error) {
+	s := &s3Store{
+		endpoint:  strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		bucket:    os.Getenv("S3_BUCKET"),
+		region:    os.Getenv("S3_REGION"),
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		client:    &http.Client{},
+	}
+	if s.bucket == "" {
+		return nil, errors.New("S3_BUCKET should be set")
+	}
+	if s.region == "" {
+		s.region = defaultS3Region
+	}
+	return s, nil
+}
+
+// do sends a signed request with extra unsigned header, failing unless it
+// succeeds.
+func (s *s3Store) do(method string, path string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.endpoint+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.URL.RawQuery = canonicalQuery(query)
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s %s", errNoBlob, method, path)
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, message)
+}
+
+// canonicalQuery encodes query the way AWS Signature Version 4 expects.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds AWS Signature Version 4 headers to req, payloadHash being the
+// SHA-256 of its body in hex, which the service checks.
+func (s *s3Store) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSha256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func (s *s3Store) objectPath(key string) string {
+	return "/" + s.bucket + "/" + key
+}
+
+func (s *s3Store) Open(key string, offset int64) (io.ReadCloser, error) {
+	var header http.Header
+	if offset > 0 {
+		header = http.Header{"Range": {"bytes=" + strconv.FormatInt(offset, 10) + "-"}}
+	}
+	resp, err := s.do("GET", s.objectPath(key), nil, header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", s.objectPath(key), nil, nil, nil, 0, emptyPayloadHash)
+	if errors.Is(err, errNoBlob) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,334 @@
+// +build !solution
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"golang.org/x/text/encoding/charmap"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// importFormat describes how an uploaded file is laid out. Empty fields
+// mean defaults, which are what store exports.
+type importFormat struct {
+	Delimiter         string `json:"delimiter"`
+	CategorySeparator string `json:"category_separator"`
+	Encoding          string `json:"encoding"`
+	// whether the first row names the columns, see headerAuto
+	Header string `json:"header"`
+}
+
+const (
+	encodingUtf8        = "utf-8"
+	encodingWindows1251 = "windows-1251"
+
+	// headerAuto takes the first row for a header if it names at least one
+	// known column and has no stock code in the first one
+	headerAuto    = "auto"
+	headerPresent = "present"
+	headerAbsent  = "absent"
+
+	defaultCategorySeparator = "&"
+)
+
+// Stock fields a column may be mapped to.
+const (
+	columnCode       = "code"
+	columnName       = "name"
+	columnCategories = "categories"
+	columnQuantity   = "quantity"
+	columnPrice      = "price"
+)
+
+// header names of columns, compared ignoring case and surrounding spaces,
+// keep in sync with csv-producer/format.go
+var columnNames = map[string]string{
+	"code":       columnCode,
+	"name":       columnName,
+	"categories": columnCategories,
+	"category":   columnCategories,
+	"quantity":   columnQuantity,
+	"qty":        columnQuantity,
+	"price":      columnPrice,
+}
+
+// the layout of files without a header
+var positionalColumns = []string{columnCode, columnName, columnCategories, columnQuantity, columnPrice}
+
+var utf8Bom = []byte("\xef\xbb\xbf")
+
+// schema tells which column holds which field of Stock. It travels with
+// chunks of a file, so that they can be read without the header.
+type schema struct {
+	Columns           map[string]int `json:"columns"`
+	CategorySeparator string         `json:"category_separator"`
+	// files without a header must have between 3 and 5 columns
+	Positional bool `json:"positional"`
+}
+
+// cell returns the value of column in record, or an empty string if the
+// record has no such column.
+func (s *schema) cell(record []string, column string) string {
+	i, ok := s.Columns[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return record[i]
+}
+
+// rowColumns tells which optional fields of Stock a row has a column for.
+// Fields without one are kept as they are when a stock is updated.
+type rowColumns struct {
+	Name       bool
+	Categories bool
+	Quantity   bool
+	Price      bool
+}
+
+func (s *schema) has(record []string, column string) bool {
+	i, ok := s.Columns[column]
+	return ok && i < len(record)
+}
+
+func (s *schema) columns(record []string) rowColumns {
+	return rowColumns{
+		Name:       s.has(record, columnName),
+		Categories: s.has(record, columnCategories),
+		Quantity:   s.has(record, columnQuantity),
+		Price:      s.has(record, columnPrice),
+	}
+}
+
+func positionalSchema(categorySeparator string) *schema {
+	s := &schema{Columns: make(map[string]int), CategorySeparator: categorySeparator, Positional: true}
+	for i, column := range positionalColumns {
+		s.Columns[column] = i
+	}
+	return s
+}
+
+// headerSchema maps columns named in header, ignoring unknown ones. It
+// returns nil if header names none.
+func headerSchema(header []string, categorySeparator string) (*schema, error) {
+	s := &schema{Columns: make(map[string]int), CategorySeparator: categorySeparator}
+	for i, name := range header {
+		column, ok := columnNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			continue
+		}
+		if _, ok := s.Columns[column]; ok {
+			return nil, fmt.Errorf("%w: column %s appears twice", errInvalidFile, column)
+		}
+		s.Columns[column] = i
+	}
+
+	if len(s.Columns) == 0 {
+		return nil, nil
+	}
+	for _, column := range []string{columnCode, columnName} {
+		if _, ok := s.Columns[column]; !ok {
+			return nil, fmt.Errorf("%w: header has no %s column", errInvalidFile, column)
+		}
+	}
+	return s, nil
+}
+
+// rowReader reads rows of a file according to its format, taking care of
+// the header. Offsets count bytes of the file decoded to UTF-8, lines are
+// those of the whole file even when reading starts in the middle of it.
+type rowReader struct {
+	reader *csv.Reader
+	schema *schema
+	// the first row, if it turned out to be no header
+	first []string
+
+	// where the reader started
+	offset   int64
+	lineBase int
+	// how many bytes of the file come before its text, see chunkStart
+	prefix int64
+	// the last line of the last record read
+	line int
+	// how many more rows to read, negative for all of them
+	remaining int
+}
+
+func decode(r io.Reader, encoding string) (io.Reader, int64, error) {
+	switch strings.ToLower(encoding) {
+	case encodingUtf8, "utf8", "":
+		buffered := bufio.NewReader(r)
+		start, err := buffered.Peek(len(utf8Bom))
+		if err == nil && bytes.Equal(start, utf8Bom) {
+			_, _ = buffered.Discard(len(utf8Bom))
+			return buffered, int64(len(utf8Bom)), nil
+		}
+		return buffered, 0, nil
+	case encodingWindows1251, "cp1251":
+		return charmap.Windows1251.NewDecoder().Reader(r), 0, nil
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown encoding %s", errInvalidFile, encoding)
+	}
+}
+
+// chunkStart tells where in a file the text at offset starts, prefix being
+// the length of its byte order mark, if that can be told without decoding
+// the file up to there, which is the case for UTF-8 only.
+func chunkStart(format importFormat, prefix int64, offset int64) (int64, bool) {
+	switch strings.ToLower(format.Encoding) {
+	case encodingUtf8, "utf8", "":
+		return prefix + offset, true
+	default:
+		return 0, false
+	}
+}
+
+func newCsvReader(r io.Reader, format importFormat) (*csv.Reader, error) {
+	reader := csv.NewReader(r)
+	// optional columns may be left out, so rows may differ in length
+	reader.FieldsPerRecord = -1
+	if format.Delimiter != "" {
+		delimiter, size := utf8.DecodeRuneInString(format.Delimiter)
+		if size != len(format.Delimiter) {
+			return nil, fmt.Errorf("%w: delimiter should be a single character", errInvalidFile)
+		}
+		reader.Comma = delimiter
+	}
+	return reader, nil
+}
+
+// newRowReader reads a file from the start, working out its schema.
+func newRowReader(r io.Reader, format importFormat) (*rowReader, error) {
+	decoded, prefix, err := decode(r, format.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newCsvReader(decoded, format)
+	if err != nil {
+		return nil, err
+	}
+
+	categorySeparator := format.CategorySeparator
+	if categorySeparator == "" {
+		categorySeparator = defaultCategorySeparator
+	}
+
+	rows := &rowReader{reader: reader, schema: positionalSchema(categorySeparator), prefix: prefix, remaining: -1}
+	if format.Header == headerAbsent {
+		return rows, nil
+	}
+
+	first, err := reader.Read()
+	if err == io.EOF {
+		return rows, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidFile, err)
+	}
+
+	s, err := headerSchema(first, categorySeparator)
+	if err != nil {
+		return nil, err
+	}
+	if format.Header == headerPresent {
+		if s == nil {
+			return nil, fmt.Errorf("%w: header names no known columns", errInvalidFile)
+		}
+		rows.schema = s
+		rows.line, _ = reader.FieldPos(len(first) - 1)
+		return rows, nil
+	}
+
+	// a code in the first column means there is no header
+	_, codeErr := strconv.ParseUint(strings.TrimSpace(first[0]), 10, 64)
+	if s != nil && codeErr != nil {
+		rows.schema = s
+		rows.line, _ = reader.FieldPos(len(first) - 1)
+	} else {
+		rows.first = first
+	}
+	return rows, nil
+}
+
+// newChunkReader reads count rows of a file with a known schema, starting
+// after line at offset. r starts there already if seeked is set, as told by
+// chunkStart, otherwise it starts at the beginning of the file.
+func newChunkReader(r io.Reader, format importFormat, s *schema, offset int64, line int, count int, seeked bool) (*rowReader, error) {
+	var decoded io.Reader = r
+	if !seeked {
+		var err error
+		decoded, _, err = decode(r, format.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.CopyN(ioutil.Discard, decoded, offset)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidFile, err)
+		}
+	}
+	reader, err := newCsvReader(decoded, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rowReader{reader: reader, schema: s, offset: offset, lineBase: line, line: line, remaining: count}, nil
+}
+
+// position returns the offset right after the last row read and the line
+// it ends on.
+func (rr *rowReader) position() (int64, int) {
+	if rr.first != nil {
+		return rr.offset, rr.lineBase
+	}
+	return rr.offset + rr.reader.InputOffset(), rr.line
+}
+
+// each calls handle for every row until it returns an error.
+func (rr *rowReader) each(handle func(r row) error) error {
+	for rr.remaining != 0 {
+		offset, line := rr.position()
+
+		var record []string
+		var err error
+		if rr.first != nil {
+			record, rr.first = rr.first, nil
+		} else {
+			record, err = rr.reader.Read()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if rr.remaining > 0 {
+			rr.remaining--
+		}
+
+		r := row{Offset: offset, LineBefore: line}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			// the reader goes on with the next line after a parse error
+			r.Line, r.Err = rr.lineBase+parseErr.StartLine, parseErr.Err
+			rr.line = rr.lineBase + parseErr.Line
+		} else if err != nil {
+			return err
+		} else {
+			start, _ := rr.reader.FieldPos(0)
+			end, _ := rr.reader.FieldPos(len(record) - 1)
+			r.Line, r.Code = rr.lineBase+start, rr.schema.cell(record, columnCode)
+			r.Stock, r.Err = parseRecord(record, rr.schema)
+			r.Columns = rr.schema.columns(record)
+			rr.line = rr.lineBase + end
+		}
+
+		err = handle(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
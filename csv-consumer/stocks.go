@@ -0,0 +1,280 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Indexes, trash and audit streams kept by store next to the stocks, see
+// store/stocks.go, store/search.go, store/trash.go and store/audit.go.
+// Whatever the importer writes keeps them in sync the same way store does.
+const (
+	stocksIndexKey      = "index:stocks"
+	categoriesIndexKey  = "index:categories"
+	categoryIndexPrefix = "index:category:"
+	tokensIndexKey      = "index:tokens"
+	tokenIndexPrefix    = "index:token:"
+
+	trashPrefix   = "trash:"
+	trashIndexKey = "index:trash"
+
+	auditStreamKey   = "audit"
+	stockAuditPrefix = "audit:"
+	// who the audit log names as the author of stocks imported from files
+	// queued before uploaders were known
+	importActor = "csv-import"
+
+	nameTokenWeight     = 2
+	categoryTokenWeight = 1
+)
+
+var removeFromIndexScript = `
+redis.call('ZREM', KEYS[1], ARGV[1])
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+return 0
+`
+
+type tombstone struct {
+	Stock     *Stock    `json:"stock"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by"`
+}
+
+func indexMember(code uint64) string {
+	return fmt.Sprintf("%020d", code)
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func getStocks(c redis.Cmdable, keys []string) ([]*Stock, error) {
+	stocks := make([]*Stock, len(keys))
+	if len(keys) == 0 {
+		return stocks, nil
+	}
+
+	values, err := c.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		contents, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var stock Stock
+		err = json.Unmarshal([]byte(contents), &stock)
+		if err != nil {
+			return nil, err
+		}
+		stocks[i] = &stock
+	}
+	return stocks, nil
+}
+
+// getPrevious tells what the last versions of stocks under keys are: olds,
+// or those in the trash where olds are nil, see store/trash.go.
+func getPrevious(c redis.Cmdable, keys []string, olds []*Stock) ([]*Stock, error) {
+	previous := make([]*Stock, len(keys))
+	var trashKeys []string
+	var missing []int
+	for i, old := range olds {
+		if old != nil {
+			previous[i] = old
+		} else {
+			trashKeys = append(trashKeys, trashPrefix+keys[i])
+			missing = append(missing, i)
+		}
+	}
+	if len(trashKeys) == 0 {
+		return previous, nil
+	}
+
+	values, err := c.MGet(trashKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for j, value := range values {
+		contents, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var deleted tombstone
+		err = json.Unmarshal([]byte(contents), &deleted)
+		if err != nil {
+			return nil, err
+		}
+		previous[missing[j]] = deleted.Stock
+	}
+	return previous, nil
+}
+
+// writeStock queues commands replacing old with stock under code on behalf
+// of actor, and deleting it into the trash if stock is nil.
+func writeStock(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock, actor string) error {
+	return writeStockAfter(pipe, code, old, old, stock, actor)
+}
+
+// writeStockAfter is writeStock for a stock whose last version is previous,
+// which differs from old for stocks created again after being deleted.
+// Version and price history of stock follow previous, as in store.
+func writeStockAfter(pipe redis.Pipeliner, code uint64, old *Stock, previous *Stock, stock *Stock, actor string) error {
+	key := strconv.FormatUint(code, 10)
+
+	if stock == nil {
+		pipe.Del(key)
+		if old != nil {
+			err := trashStock(pipe, old, actor)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		stock.Version = 1
+		if previous != nil {
+			stock.Version = previous.Version + 1
+		}
+
+		contents, err := json.Marshal(stock)
+		if err != nil {
+			return err
+		}
+		pipe.Set(key, contents, 0)
+	}
+
+	indexStock(pipe, code, old, stock)
+
+	err := recordPrice(pipe, code, previous, stock)
+	if err != nil {
+		return err
+	}
+	return recordAudit(pipe, code, old, stock, actor)
+}
+
+func trashStock(pipe redis.Pipeliner, stock *Stock, actor string) error {
+	now := time.Now().UTC()
+	contents, err := json.Marshal(tombstone{Stock: stock, DeletedAt: now, DeletedBy: actor})
+	if err != nil {
+		return err
+	}
+
+	code := strconv.FormatUint(stock.Code, 10)
+	pipe.Set(trashPrefix+code, contents, 0)
+	pipe.ZAdd(trashIndexKey, &redis.Z{Score: float64(now.Unix()), Member: code})
+	return nil
+}
+
+// indexStock queues commands moving code in the indexes from where old
+// belongs to where stock belongs. Either of them may be nil.
+func indexStock(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock) {
+	member := indexMember(code)
+
+	if stock == nil {
+		pipe.ZRem(stocksIndexKey, member)
+	} else {
+		pipe.ZAdd(stocksIndexKey, &redis.Z{Member: member})
+	}
+
+	oldCategories := make(map[string]bool)
+	if old != nil {
+		for _, category := range old.Categories {
+			oldCategories[category] = true
+		}
+	}
+	newCategories := make(map[string]bool)
+	if stock != nil {
+		for _, category := range stock.Categories {
+			newCategories[category] = true
+		}
+	}
+
+	for category := range newCategories {
+		if !oldCategories[category] {
+			pipe.ZAdd(categoryIndexPrefix+category, &redis.Z{Member: member})
+			pipe.ZAdd(categoriesIndexKey, &redis.Z{Member: category})
+		}
+	}
+	for category := range oldCategories {
+		if !newCategories[category] {
+			pipe.Eval(removeFromIndexScript, []string{categoryIndexPrefix + category, categoriesIndexKey}, member, category)
+		}
+	}
+
+	oldTokens := stockTokens(old)
+	newTokens := stockTokens(stock)
+	for token, weight := range newTokens {
+		if oldWeight, ok := oldTokens[token]; !ok || oldWeight != weight {
+			pipe.ZAdd(tokenIndexPrefix+token, &redis.Z{Score: weight, Member: member})
+			pipe.ZAdd(tokensIndexKey, &redis.Z{Member: token})
+		}
+	}
+	for token := range oldTokens {
+		if _, ok := newTokens[token]; !ok {
+			pipe.Eval(removeFromIndexScript, []string{tokenIndexPrefix + token, tokensIndexKey}, member, token)
+		}
+	}
+}
+
+func stockTokens(stock *Stock) map[string]float64 {
+	tokens := make(map[string]float64)
+	if stock == nil {
+		return tokens
+	}
+
+	for _, token := range tokenize(stock.Name) {
+		tokens[token] = nameTokenWeight
+	}
+	for _, category := range stock.Categories {
+		for _, token := range tokenize(category) {
+			if _, ok := tokens[token]; !ok {
+				tokens[token] = categoryTokenWeight
+			}
+		}
+	}
+	return tokens
+}
+
+// recordAudit queues commands appending the change from old to stock to
+// the audit streams.
+func recordAudit(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock, actor string) error {
+	operation := "update"
+	if old == nil {
+		operation = "create"
+	} else if stock == nil {
+		operation = "delete"
+	}
+
+	before, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(stock)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{
+		"actor":     actor,
+		"operation": operation,
+		"code":      strconv.FormatUint(code, 10),
+		"before":    before,
+		"after":     after,
+	}
+	pipe.XAdd(&redis.XAddArgs{Stream: auditStreamKey, Values: values})
+	pipe.XAdd(&redis.XAddArgs{Stream: stockAuditPrefix + strconv.FormatUint(code, 10), Values: values})
+	return nil
+}
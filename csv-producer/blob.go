@@ -0,0 +1,204 @@
+// +build !solution
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Uploads are kept in a blob store under the id of their job until
+// csv-consumer imports them, see csv-consumer/blob.go. Small ones travel
+// inside the queue message instead.
+const (
+	blobLocal  = "local"
+	blobInline = "inline"
+	blobS3     = "s3"
+
+	defaultBlobDir         = "/tmp/blobs"
+	defaultBlobInlineLimit = 64 << 10
+
+	blobCleanupInterval = time.Hour
+	// younger blobs may belong to an upload whose job is not created yet
+	blobOrphanAge = time.Hour
+)
+
+// blobRef tells csv-consumer where an upload is, keep in sync with
+// csv-consumer.
+type blobRef struct {
+	Store string `json:"store"`
+	Key   string `json:"key,omitempty"`
+	// contents of inline blobs
+	Data []byte `json:"data,omitempty"`
+	Size int64  `json:"size"`
+	// SHA-256 of the contents in hex
+	Sha256 string `json:"sha256"`
+}
+
+type blobInfo struct {
+	Key     string
+	ModTime time.Time
+}
+
+type blobStore interface {
+	// Put stores size bytes of r under key, sum being their SHA-256.
+	Put(key string, r io.Reader, size int64, sum string) (blobRef, error)
+	Delete(key string) error
+	// List tells what is stored, so that orphans can be cleaned up.
+	List() ([]blobInfo, error)
+}
+
+var (
+	blobs       blobStore
+	inlineBlobs blobStore = inlineStore{}
+	// uploads no bigger than that are inlined whatever the store is
+	blobInlineLimit int64
+)
+
+// newBlobStore picks a store according to BLOB_STORE, which is one of
+// local (default), inline and s3. Local keeps files in BLOB_DIR, s3 is
+// configured as described in newS3Store.
+func newBlobStore() (blobStore, error) {
+	kind := os.Getenv("BLOB_STORE")
+	switch kind {
+	case "", blobLocal:
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = defaultBlobDir
+		}
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return localStore{dir: dir}, nil
+	case blobInline:
+		return inlineStore{}, nil
+	case blobS3:
+		return newS3Store()
+	default:
+		return nil, errors.New("unknown BLOB_STORE " + kind)
+	}
+}
+
+// getBlobInlineLimit reads the size in bytes of uploads which are inlined
+// from BLOB_INLINE_LIMIT, 0 turns inlining off.
+func getBlobInlineLimit() (int64, error) {
+	value := os.Getenv("BLOB_INLINE_LIMIT")
+	if value == "" {
+		return defaultBlobInlineLimit, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// localStore keeps blobs as files of a directory, which has to be shared
+// with csv-consumer.
+type localStore struct {
+	dir string
+}
+
+func (s localStore) Put(key string, r io.Reader, size int64, sum string) (blobRef, error) {
+	path := filepath.Join(s.dir, key)
+	f, err := os.Create(path)
+	if err != nil {
+		return blobRef{}, err
+	}
+
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return blobRef{}, err
+	}
+	return blobRef{Store: blobLocal, Key: key, Size: size, Sha256: sum}, nil
+}
+
+func (s localStore) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s localStore) List() ([]blobInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]blobInfo, 0, len(files))
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			infos = append(infos, blobInfo{Key: file.Name(), ModTime: file.ModTime()})
+		}
+	}
+	return infos, nil
+}
+
+// inlineStore puts blobs into queue messages, so there is nothing to
+// delete or clean up.
+type inlineStore struct{}
+
+func (inlineStore) Put(key string, r io.Reader, size int64, sum string) (blobRef, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return blobRef{}, err
+	}
+	return blobRef{Store: blobInline, Data: data, Size: size, Sha256: sum}, nil
+}
+
+func (inlineStore) Delete(key string) error {
+	return nil
+}
+
+func (inlineStore) List() ([]blobInfo, error) {
+	return nil, nil
+}
+
+// cleanOrphanedBlobs deletes blobs of finished jobs, which csv-consumer
+// failed to delete, and of jobs which were never created or are gone.
+func cleanOrphanedBlobs() error {
+	infos, err := blobs.List()
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(-blobOrphanAge)
+	for _, info := range infos {
+		if info.ModTime.After(deadline) {
+			continue
+		}
+
+		job, err := getJobFrom(jobsClient, info.Key)
+		if err != nil {
+			return err
+		}
+		if job != nil && job.State != jobSucceeded && job.State != jobFailed {
+			continue
+		}
+
+		log.Printf("Removing orphaned blob %s\n", info.Key)
+		err = blobs.Delete(info.Key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cleanOrphanedBlobsForever() {
+	for range time.Tick(blobCleanupInterval) {
+		err := cleanOrphanedBlobs()
+		if err != nil {
+			log.Printf("%s: %s", "Failed to clean orphaned blobs up", err)
+		}
+	}
+}
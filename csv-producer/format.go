@@ -0,0 +1,122 @@
+// +build !solution
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// importFormat describes how an uploaded file is laid out, see
+// csv-consumer/schema.go.
+type importFormat struct {
+	Delimiter         string `json:"delimiter"`
+	CategorySeparator string `json:"category_separator"`
+	Encoding          string `json:"encoding"`
+	Header            string `json:"header"`
+}
+
+const (
+	encodingUtf8        = "utf-8"
+	encodingWindows1251 = "windows-1251"
+
+	headerAuto    = "auto"
+	headerPresent = "present"
+	headerAbsent  = "absent"
+)
+
+const (
+	columnCode = "code"
+	columnName = "name"
+)
+
+// header names of columns, keep in sync with csv-consumer/schema.go
+var columnNames = map[string]string{
+	"code":       columnCode,
+	"name":       columnName,
+	"categories": "categories",
+	"category":   "categories",
+	"quantity":   "quantity",
+	"qty":        "quantity",
+	"price":      "price",
+}
+
+var errNoKnownColumns = errors.New("header names no known columns")
+
+// headerColumns tells which column header names are where, the way
+// headerSchema in csv-consumer/schema.go does. It fails with
+// errNoKnownColumns if header names none.
+func headerColumns(header []string) (map[string]int, error) {
+	columns := make(map[string]int)
+	for i, name := range header {
+		column, ok := columnNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			continue
+		}
+		if _, ok := columns[column]; ok {
+			return nil, fmt.Errorf("column %s appears twice", column)
+		}
+		columns[column] = i
+	}
+
+	if len(columns) == 0 {
+		return nil, errNoKnownColumns
+	}
+	for _, column := range []string{columnCode, columnName} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("header has no %s column", column)
+		}
+	}
+	return columns, nil
+}
+
+var encodingAliases = map[string]string{
+	"":             encodingUtf8,
+	"utf-8":        encodingUtf8,
+	"utf8":         encodingUtf8,
+	"windows-1251": encodingWindows1251,
+	"cp1251":       encodingWindows1251,
+}
+
+// parseImportFormat reads the delimiter, category_separator, encoding and
+// header form fields, answering with an error if any of them is bad.
+func parseImportFormat(w http.ResponseWriter, r *http.Request) (importFormat, bool) {
+	format := importFormat{
+		Delimiter:         r.FormValue("delimiter"),
+		CategorySeparator: r.FormValue("category_separator"),
+		Header:            r.FormValue("header"),
+	}
+
+	// a tab is hard to put into a form field
+	if format.Delimiter == `\t` || format.Delimiter == "tab" {
+		format.Delimiter = "\t"
+	}
+	if format.Delimiter != "" {
+		delimiter, size := utf8.DecodeRuneInString(format.Delimiter)
+		if size != len(format.Delimiter) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+			util.ErrorAsJson(w, "Bad delimiter, should be a single character other than a quote or a line break", http.StatusBadRequest)
+			return format, false
+		}
+	}
+
+	encoding, ok := encodingAliases[strings.ToLower(r.FormValue("encoding"))]
+	if !ok {
+		util.ErrorAsJson(w, "Bad encoding, should be utf-8 or windows-1251", http.StatusBadRequest)
+		return format, false
+	}
+	format.Encoding = encoding
+
+	if format.Header == "" {
+		format.Header = headerAuto
+	}
+	if format.Header != headerAuto && format.Header != headerPresent && format.Header != headerAbsent {
+		util.ErrorAsJson(w, "Bad header, should be auto, present or absent", http.StatusBadRequest)
+		return format, false
+	}
+
+	return format, true
+}
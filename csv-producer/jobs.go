@@ -0,0 +1,240 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Every upload is tracked as a job, a hash under jobPrefix holding the
+// fields of Job. Rows which were not written are described in a list under
+// jobReportPrefix, filled by csv-consumer.
+const (
+	jobPrefix       = "job:"
+	jobReportPrefix = "job-report:"
+
+	// how long jobs are kept after they are created
+	jobRetention = 7 * 24 * time.Hour
+)
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+type Job struct {
+	Id       string `json:"id"`
+	State    string `json:"state"`
+	FileName string `json:"file_name"`
+	Policy   string `json:"policy"`
+	Mode     string `json:"mode"`
+	// dry runs write nothing, counters and the report tell what they would
+	// have done
+	DryRun bool `json:"dry_run"`
+	// SHA-256 of the file, telling duplicate uploads apart
+	Sha256     string `json:"sha256"`
+	UploadedBy string `json:"uploaded_by"`
+	// rows in the file and chunks they are split into, known once the
+	// file is scanned, while Rows counts those imported so far
+	Total   int64 `json:"total"`
+	Chunks  int64 `json:"chunks"`
+	Rows    int64 `json:"rows"`
+	Written int64 `json:"written"`
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+	// stocks deleted for not being in a file imported in replace-all mode
+	Deleted   int64     `json:"deleted"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ReportUrl string    `json:"report_url"`
+}
+
+// jobReportEntry is written by csv-consumer, deleted stocks have no line.
+// Stocks are there for dry runs only.
+type jobReportEntry struct {
+	Line    int             `json:"line,omitempty"`
+	Code    string          `json:"code"`
+	Outcome string          `json:"outcome"`
+	Reason  string          `json:"reason,omitempty"`
+	Action  string          `json:"action,omitempty"`
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+}
+
+// createJob creates a queued job for message, fileName is the name of the
+// uploaded file.
+func createJob(message importMessage, fileName string) error {
+	id := message.JobId
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	_, err := jobsClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(jobPrefix+id,
+			"state", jobQueued,
+			"file_name", fileName,
+			"policy", message.Policy,
+			"mode", message.Mode,
+			"dry_run", strconv.FormatBool(message.DryRun),
+			"sha256", message.Blob.Sha256,
+			"uploaded_by", message.Uploader,
+			"rows", 0,
+			"written", 0,
+			"skipped", 0,
+			"failed", 0,
+			"deleted", 0,
+			"error", "",
+			"created_at", now,
+			"updated_at", now,
+		)
+		pipe.Expire(jobPrefix+id, jobRetention)
+		return nil
+	})
+	return err
+}
+
+// failJob marks a job failed before csv-consumer ever got it.
+func failJob(id string, message string) error {
+	return jobsClient.HSet(jobPrefix+id,
+		"state", jobFailed,
+		"error", message,
+		"updated_at", time.Now().UTC().Format(time.RFC3339Nano),
+	).Err()
+}
+
+// getJobFrom returns nil if there is no job with id.
+func getJobFrom(c redis.Cmdable, id string) (*Job, error) {
+	fields, err := c.HGetAll(jobPrefix + id).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	job := &Job{
+		Id:         id,
+		State:      fields["state"],
+		FileName:   fields["file_name"],
+		Policy:     fields["policy"],
+		Mode:       fields["mode"],
+		Sha256:     fields["sha256"],
+		UploadedBy: fields["uploaded_by"],
+		Error:      fields["error"],
+		ReportUrl:  "/jobs/" + id + "/report",
+	}
+	job.DryRun, _ = strconv.ParseBool(fields["dry_run"])
+	job.Total, _ = strconv.ParseInt(fields["total"], 10, 64)
+	job.Chunks, _ = strconv.ParseInt(fields["chunks"], 10, 64)
+	job.Rows, _ = strconv.ParseInt(fields["rows"], 10, 64)
+	job.Written, _ = strconv.ParseInt(fields["written"], 10, 64)
+	job.Skipped, _ = strconv.ParseInt(fields["skipped"], 10, 64)
+	job.Failed, _ = strconv.ParseInt(fields["failed"], 10, 64)
+	job.Deleted, _ = strconv.ParseInt(fields["deleted"], 10, 64)
+	job.CreatedAt, _ = time.Parse(time.RFC3339Nano, fields["created_at"])
+	job.UpdatedAt, _ = time.Parse(time.RFC3339Nano, fields["updated_at"])
+	return job, nil
+}
+
+// getRequestedJob reads job with id from request path, answering with an
+// error if there is none.
+func getRequestedJob(w http.ResponseWriter, r *http.Request) (*Job, bool) {
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+
+	job, err := getJobFrom(jobsClient, vars["id"])
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from jobs database", http.StatusInternalServerError)
+		return nil, false
+	}
+	if job == nil {
+		util.ErrorAsJson(w, "No such job", http.StatusNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	job, ok := getRequestedJob(w, r)
+	if !ok {
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(job)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getJobReport answers with rows which were not written, with their line
+// numbers and reasons, or with every row and deleted stock of a dry run.
+// It is a CSV unless format=json is asked for, which has stocks before and
+// after as well.
+func getJobReport(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	job, ok := getRequestedJob(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		util.ErrorAsJson(w, "Bad format, should be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	contents, err := jobsClient.LRange(jobReportPrefix+job.Id, 0, -1).Result()
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from jobs database", http.StatusInternalServerError)
+		return
+	}
+
+	entries := make([]jobReportEntry, 0, len(contents))
+	for _, entryContents := range contents {
+		var entry jobReportEntry
+		err = json.Unmarshal([]byte(entryContents), &entry)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if format == "json" {
+		err = json.NewEncoder(w).Encode(entries)
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+			return
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="job-`+job.Id+`-report.csv"`)
+
+	writer := csv.NewWriter(w)
+	_ = writer.Write([]string{"line", "code", "outcome", "action", "reason"})
+	for _, entry := range entries {
+		line := ""
+		if entry.Line != 0 {
+			line = strconv.Itoa(entry.Line)
+		}
+		_ = writer.Write([]string{line, entry.Code, entry.Outcome, entry.Action, entry.Reason})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,195 @@
+// +build !solution
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxUploadSize = 256 << 20
+	// parts of a form other than the file are small
+	maxFormOverhead = 1 << 20
+	// how much of a form is kept in memory, the rest goes to temporary files
+	maxFormMemory = 32 << 20
+
+	// how much of a file is looked at before it is accepted, and how many
+	// rows of it are checked
+	sniffSize       = 64 << 10
+	sanityCheckRows = 10
+
+	// uploads by SHA-256 of their contents, pointing to the last job
+	uploadPrefix = "upload:"
+)
+
+var (
+	allowedExtensions = map[string]bool{
+		".csv": true,
+		".tsv": true,
+		".txt": true,
+	}
+	// what clients claim CSV files are, spreadsheet software included
+	allowedContentTypes = map[string]bool{
+		"text/csv":                  true,
+		"text/plain":                true,
+		"text/tab-separated-values": true,
+		"application/csv":           true,
+		"application/vnd.ms-excel":  true,
+		"application/octet-stream":  true,
+	}
+
+	utf8Bom = []byte("\xef\xbb\xbf")
+
+	maxUploadSize int64
+)
+
+// getMaxUploadSize reads the size in bytes of the biggest file accepted
+// from UPLOAD_MAX_SIZE.
+func getMaxUploadSize() (int64, error) {
+	value := os.Getenv("UPLOAD_MAX_SIZE")
+	if value == "" {
+		return defaultMaxUploadSize, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err == nil && size <= 0 {
+		err = errors.New("UPLOAD_MAX_SIZE should be positive")
+	}
+	return size, err
+}
+
+// checkUploadType fails unless the name, the declared type and the start
+// of a file all say it is text.
+func checkUploadType(fileName string, contentType string, start []byte) error {
+	if extension := strings.ToLower(filepath.Ext(fileName)); extension != "" && !allowedExtensions[extension] {
+		return fmt.Errorf("file extension %s is not allowed, should be .csv, .tsv or .txt", extension)
+	}
+
+	if contentType != "" {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+		if !allowedContentTypes[mediaType] {
+			return fmt.Errorf("content type %s is not allowed, should be text/csv", mediaType)
+		}
+	}
+
+	detected := http.DetectContentType(start)
+	if !strings.HasPrefix(detected, "text/plain") {
+		return fmt.Errorf("file looks like %s, not CSV", detected)
+	}
+	return nil
+}
+
+// checkFirstRows parses the first rows of a file, failing if they can not
+// be stocks in format, so that a wrong delimiter or encoding is noticed
+// before a job is created. start is the beginning of the file, complete
+// says whether it is the whole of it.
+func checkFirstRows(start []byte, complete bool, format importFormat) error {
+	start = bytes.TrimPrefix(start, utf8Bom)
+	if !complete {
+		// the last line is most likely cut short
+		if end := bytes.LastIndexByte(start, '\n'); end >= 0 {
+			start = start[:end+1]
+		}
+	}
+	if len(bytes.TrimSpace(start)) == 0 {
+		return errors.New("file is empty")
+	}
+
+	if format.Encoding == encodingUtf8 && !utf8.Valid(start) {
+		return errors.New("file is not valid UTF-8, set encoding")
+	}
+
+	reader := csv.NewReader(bytes.NewReader(start))
+	// optional columns may be left out, so rows may differ in length
+	reader.FieldsPerRecord = -1
+	if format.Delimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(format.Delimiter)
+	}
+
+	// with a header, columns may go in any order, see
+	// csv-consumer/schema.go, otherwise rows are positional
+	var columns map[string]int
+	for i := 0; i < sanityCheckRows; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if len(record) < 2 {
+			return fmt.Errorf("line %d has a single column, check the delimiter", line)
+		}
+
+		_, codeErr := strconv.ParseUint(strings.TrimSpace(record[0]), 10, 64)
+		if i == 0 && format.Header != headerAbsent {
+			columns, err = headerColumns(record)
+			if errors.Is(err, errNoKnownColumns) && format.Header == headerAuto {
+				err = nil
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			// a code in the first column means there is no header
+			if format.Header == headerPresent || columns != nil && codeErr != nil {
+				continue
+			}
+			columns = nil
+		}
+
+		if columns == nil {
+			if codeErr != nil {
+				return fmt.Errorf("line %d does not start with a stock code", line)
+			}
+			if len(record) < 3 || len(record) > 5 {
+				return fmt.Errorf("line %d has %d columns, should be 3 to 5", line, len(record))
+			}
+			continue
+		}
+
+		column := columns[columnCode]
+		if column >= len(record) {
+			return fmt.Errorf("line %d has no %s column", line, columnCode)
+		}
+		_, err = strconv.ParseUint(strings.TrimSpace(record[column]), 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d has no stock code in the %s column", line, columnCode)
+		}
+	}
+	return nil
+}
+
+// findDuplicateJob returns the job which imported a file with checksum sum
+// before, unless it failed or is gone, in which case importing the file
+// again is fine.
+func findDuplicateJob(sum string) (*Job, error) {
+	id, err := jobsClient.Get(uploadPrefix + sum).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	job, err := getJobFrom(jobsClient, id)
+	if err != nil || job == nil || job.State == jobFailed {
+		return nil, err
+	}
+	return job, nil
+}
+
+// rememberUpload records that a file with checksum sum is imported by job
+// with id.
+func rememberUpload(sum string, id string) error {
+	return jobsClient.Set(uploadPrefix+sum, id, jobRetention).Err()
+}
@@ -0,0 +1,203 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// stream of all stock mutations
+	auditStreamKey = "audit"
+	// prefix of per-stock streams of mutations
+	stockAuditPrefix = "audit:"
+)
+
+const (
+	auditCreate = "create"
+	auditUpdate = "update"
+	auditDelete = "delete"
+)
+
+type auditEntry struct {
+	Id        string          `json:"id"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	Operation string          `json:"operation"`
+	Code      uint64          `json:"code"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+}
+
+type auditPage struct {
+	Entries    []auditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor"`
+}
+
+func stockAuditKey(code uint64) string {
+	return stockAuditPrefix + strconv.FormatUint(code, 10)
+}
+
+// recordAudit queues commands appending the change from old to stock to
+// the audit streams. Stream ids carry the time of the change.
+func recordAudit(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock, actor string) error {
+	operation := auditUpdate
+	if old == nil {
+		operation = auditCreate
+	} else if stock == nil {
+		operation = auditDelete
+	}
+
+	before, err := json.Marshal(old)
+	if err != nil {
+		return err
+	}
+	after, err := json.Marshal(stock)
+	if err != nil {
+		return err
+	}
+
+	values := map[string]interface{}{
+		"actor":     actor,
+		"operation": operation,
+		"code":      strconv.FormatUint(code, 10),
+		"before":    before,
+		"after":     after,
+	}
+	pipe.XAdd(&redis.XAddArgs{Stream: auditStreamKey, Values: values})
+	pipe.XAdd(&redis.XAddArgs{Stream: stockAuditKey(code), Values: values})
+	return nil
+}
+
+func parseAuditEntry(message redis.XMessage) auditEntry {
+	entry := auditEntry{Id: message.ID}
+
+	milliseconds, _ := strconv.ParseInt(strings.SplitN(message.ID, "-", 2)[0], 10, 64)
+	entry.Time = time.Unix(0, milliseconds*int64(time.Millisecond)).UTC()
+
+	entry.Actor, _ = message.Values["actor"].(string)
+	entry.Operation, _ = message.Values["operation"].(string)
+	code, _ := message.Values["code"].(string)
+	entry.Code, _ = strconv.ParseUint(code, 10, 64)
+	before, _ := message.Values["before"].(string)
+	entry.Before = json.RawMessage(before)
+	after, _ := message.Values["after"].(string)
+	entry.After = json.RawMessage(after)
+	return entry
+}
+
+// nextStreamId returns the smallest stream id greater than id.
+func nextStreamId(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", strconv.ErrSyntax
+	}
+	milliseconds, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	sequence, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(milliseconds, 10) + "-" + strconv.FormatUint(sequence+1, 10), nil
+}
+
+// parseAuditTime turns an RFC 3339 time into a stream id bound.
+func parseAuditTime(value string, bound string) (string, error) {
+	if value == "" {
+		return bound, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10), nil
+}
+
+// answerAudit answers with a page of stream entries limited by from, to,
+// limit and cursor query parameters.
+func answerAudit(w http.ResponseWriter, r *http.Request, stream string) {
+	query := r.URL.Query()
+
+	limit := defaultPageLimit
+	if limitString := query.Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			util.ErrorAsJson(w, "Bad limit, should be between 1 and "+strconv.Itoa(maxPageLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	start, err := parseAuditTime(query.Get("from"), "-")
+	if err != nil {
+		util.ErrorAsJson(w, "Bad from, should be RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	stop, err := parseAuditTime(query.Get("to"), "+")
+	if err != nil {
+		util.ErrorAsJson(w, "Bad to, should be RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	// the cursor is the id of the last entry seen
+	if cursor := query.Get("cursor"); cursor != "" {
+		start, err = nextStreamId(cursor)
+		if err != nil {
+			util.ErrorAsJson(w, "Bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	messages, err := stocksClient.XRangeN(stream, start, stop, int64(limit)).Result()
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from audit database", http.StatusInternalServerError)
+		return
+	}
+
+	page := auditPage{Entries: make([]auditEntry, len(messages))}
+	for i, message := range messages {
+		page.Entries[i] = parseAuditEntry(message)
+	}
+	if len(messages) == limit {
+		page.NextCursor = messages[len(messages)-1].ID
+	}
+
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+func getStockHistory(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+	code, err := strconv.ParseUint(vars["code"], 10, 64)
+	if err != nil {
+		util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+		return
+	}
+
+	answerAudit(w, r, stockAuditKey(code))
+}
+
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	answerAudit(w, r, auditStreamKey)
+}
@@ -0,0 +1,308 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+)
+
+// how many items a single batch request may contain
+const maxBatchSize = 1000
+
+const (
+	// all items are applied or none of them
+	batchAtomic = "atomic"
+	// every item is applied if it can be
+	batchBestEffort = "best_effort"
+)
+
+var (
+	errBatchFailed = errors.New("batch failed")
+	// wraps everything wrong with a stock in a batch item
+	errBadStock = errors.New("bad stock")
+)
+
+type badStockError struct {
+	reason string
+}
+
+func (e *badStockError) Error() string {
+	return e.reason
+}
+
+func (e *badStockError) Unwrap() error {
+	return errBadStock
+}
+
+type batchResult struct {
+	Code   uint64 `json:"code"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Stock  *Stock `json:"stock,omitempty"`
+}
+
+type batchResponse struct {
+	Applied bool          `json:"applied"`
+	Results []batchResult `json:"results"`
+}
+
+// stockErrorString describes what went wrong with a single stock, in the
+// manner of util.RedisErrorString.
+func stockErrorString(err error) (string, int) {
+	if errors.Is(err, errNoStock) {
+		return "No such stock", http.StatusNotFound
+	} else if errors.Is(err, errStockExists) {
+		return "Stock with this code already exists", http.StatusConflict
+	} else if errors.Is(err, errNotEnoughUnits) {
+		return "Quantity can not be less than reserved units", http.StatusConflict
+	} else if errors.Is(err, errUnitsReserved) {
+		return "Stock has reserved units, ship or cancel their orders first", http.StatusConflict
+	} else if errors.Is(err, errBadStock) {
+		return err.Error(), http.StatusBadRequest
+	} else {
+		return "Unknown error while working with stocks database", http.StatusInternalServerError
+	}
+}
+
+// decodeBatch reads {"mode": ..., "items": [...]} into items and tells
+// whether the batch is atomic, answering with an error if it is malformed.
+func decodeBatch(w http.ResponseWriter, r *http.Request, items interface{}) (bool, bool) {
+	var data struct {
+		Mode  string          `json:"mode"`
+		Items json.RawMessage `json:"items"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to unmarshal request body", http.StatusBadRequest)
+		return false, false
+	}
+
+	atomic := true
+	switch data.Mode {
+	case "", batchAtomic:
+	case batchBestEffort:
+		atomic = false
+	default:
+		util.ErrorAsJson(w, "Mode should be "+batchAtomic+" or "+batchBestEffort, http.StatusBadRequest)
+		return false, false
+	}
+
+	err = json.Unmarshal(data.Items, items)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to unmarshal items from request body", http.StatusBadRequest)
+		return false, false
+	}
+
+	return atomic, true
+}
+
+// checkBatchSize answers with an error unless a batch of n items is fine.
+func checkBatchSize(w http.ResponseWriter, n int) bool {
+	if n == 0 || n > maxBatchSize {
+		util.ErrorAsJson(w, "Batch should contain between 1 and "+strconv.Itoa(maxBatchSize)+" items", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// runBatch applies updates and answers with a result for each of them.
+func runBatch(w http.ResponseWriter, updates []stockUpdate, atomic bool, actor string) {
+	if !checkBatchSize(w, len(updates)) {
+		return
+	}
+
+	stocks := make([]*Stock, len(updates))
+	errs := make([]error, len(updates))
+	pending := make([]int, len(updates))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	// creations whose generated codes are taken are tried again with new
+	// ones, the whole batch if it is atomic, since nothing is written then
+	var err error
+	for attempt := 1; ; attempt++ {
+		batch := make([]stockUpdate, len(pending))
+		for j, i := range pending {
+			batch[j] = updates[i]
+		}
+
+		var batchStocks []*Stock
+		var batchErrs []error
+		batchStocks, batchErrs, err = updateStocks(batch, atomic, actor)
+		if err != nil && !errors.Is(err, errBatchFailed) {
+			_ = answerInventoryError(w, err)
+			return
+		}
+
+		var collided []int
+		for j, i := range pending {
+			stocks[i], errs[i] = batchStocks[j], batchErrs[j]
+			if errors.Is(errs[i], errStockExists) && updates[i].Recreate != nil {
+				collided = append(collided, i)
+			}
+		}
+		if len(collided) == 0 || attempt == maxCodeAttempts {
+			break
+		}
+
+		for _, i := range collided {
+			updates[i], err = updates[i].Recreate()
+			if err != nil {
+				util.ErrorAsJson(w, "Failed to generate stock code", http.StatusInternalServerError)
+				return
+			}
+		}
+		if !atomic {
+			pending = collided
+		}
+	}
+
+	response := batchResponse{Applied: err == nil, Results: make([]batchResult, len(updates))}
+	for i, update := range updates {
+		result := batchResult{Code: update.Code, Status: http.StatusOK, Stock: stocks[i]}
+		if errs[i] != nil {
+			result.Error, result.Status = stockErrorString(errs[i])
+		} else if !response.Applied {
+			result.Error, result.Status = "Not applied because other items failed", http.StatusFailedDependency
+		}
+		response.Results[i] = result
+	}
+
+	if !response.Applied {
+		w.WriteHeader(http.StatusConflict)
+	}
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+func batchCreateStocks(w http.ResponseWriter, r *http.Request) {
+	actor, ok := validateUserAndAnswer(true, w, r.Header)
+	if !ok {
+		return
+	}
+
+	var items []Stock
+	atomic, ok := decodeBatch(w, r, &items)
+	if !ok {
+		return
+	}
+	// codes are not to be wasted on a batch which is refused anyway
+	if !checkBatchSize(w, len(items)) {
+		return
+	}
+
+	updates := make([]stockUpdate, len(items))
+	for i := range items {
+		var err error
+		updates[i], err = createUpdate(items[i])
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to generate stock code", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	runBatch(w, updates, atomic, actor)
+}
+
+// createUpdate creates stock under a newly generated code.
+func createUpdate(stock Stock) (stockUpdate, error) {
+	code, err := codes.NextCode()
+	if err != nil {
+		return stockUpdate{}, err
+	}
+	stock.Code = code
+	// units can only be reserved through the inventory endpoints
+	stock.Reserved = 0
+
+	return stockUpdate{
+		Code: code,
+		Update: func(old *Stock) (*Stock, error) {
+			err := validatePrice(stock.Price)
+			if err != nil {
+				return nil, &badStockError{reason: err.Error()}
+			}
+			if old != nil {
+				return nil, errStockExists
+			}
+			created := stock
+			return &created, nil
+		},
+		Recreate: func() (stockUpdate, error) {
+			return createUpdate(stock)
+		},
+	}, nil
+}
+
+func batchUpdateStocks(w http.ResponseWriter, r *http.Request) {
+	actor, ok := validateUserAndAnswer(true, w, r.Header)
+	if !ok {
+		return
+	}
+
+	var items []Stock
+	atomic, ok := decodeBatch(w, r, &items)
+	if !ok {
+		return
+	}
+
+	updates := make([]stockUpdate, len(items))
+	for i := range items {
+		stock := items[i]
+
+		updates[i] = stockUpdate{Code: stock.Code, Update: func(old *Stock) (*Stock, error) {
+			err := validatePrice(stock.Price)
+			if err != nil {
+				return nil, &badStockError{reason: err.Error()}
+			}
+			if old == nil {
+				return nil, errNoStock
+			}
+
+			updated := stock
+			// units can only be reserved through the inventory endpoints
+			updated.Reserved = old.Reserved
+			if updated.Quantity < updated.Reserved {
+				return nil, errNotEnoughUnits
+			}
+			return &updated, nil
+		}}
+	}
+
+	runBatch(w, updates, atomic, actor)
+}
+
+func batchDeleteStocks(w http.ResponseWriter, r *http.Request) {
+	actor, ok := validateUserAndAnswer(true, w, r.Header)
+	if !ok {
+		return
+	}
+
+	var items []uint64
+	atomic, ok := decodeBatch(w, r, &items)
+	if !ok {
+		return
+	}
+
+	updates := make([]stockUpdate, len(items))
+	for i, code := range items {
+		updates[i] = stockUpdate{Code: code, Update: func(old *Stock) (*Stock, error) {
+			if old == nil {
+				return nil, errNoStock
+			}
+			if old.Reserved > 0 {
+				return nil, errUnitsReserved
+			}
+			return nil, nil
+		}}
+	}
+
+	runBatch(w, updates, atomic, actor)
+}
@@ -0,0 +1,113 @@
+// +build !solution
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ilya-pauzner/dc-store/util"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// counter behind sequenceCodeGenerator
+	stocksSequenceKey = "sequence:stocks"
+	// prefix of counters behind gtinCodeGenerator, one per company prefix
+	gtinSequencePrefix = "sequence:gtin:"
+
+	// how many taken codes createStock tolerates before giving up
+	maxCodeAttempts = 10
+)
+
+var errCodesExhausted = errors.New("no more codes left")
+
+// codeGenerator hands out codes for new stocks. A code it returns may
+// still be taken, e.g. by an imported stock, so callers should be ready to
+// ask again.
+type codeGenerator interface {
+	NextCode() (uint64, error)
+}
+
+// randomCodeGenerator returns random codes, just as auth does for tokens.
+type randomCodeGenerator struct{}
+
+func (randomCodeGenerator) NextCode() (uint64, error) {
+	return util.RandomUint64(), nil
+}
+
+// sequenceCodeGenerator returns 1, 2, 3 and so on, shared by all store
+// instances through redis.
+type sequenceCodeGenerator struct{}
+
+func (sequenceCodeGenerator) NextCode() (uint64, error) {
+	code, err := stocksClient.Incr(stocksSequenceKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	return uint64(code), nil
+}
+
+// gtinCodeGenerator returns EAN-13 (length 13) or UPC-A (length 12) codes:
+// company prefix, sequential item reference and a check digit.
+type gtinCodeGenerator struct {
+	prefix string
+	length int
+}
+
+func (g *gtinCodeGenerator) NextCode() (uint64, error) {
+	item, err := stocksClient.Incr(gtinSequencePrefix + g.prefix).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	itemDigits := g.length - 1 - len(g.prefix)
+	body := fmt.Sprintf("%s%0*d", g.prefix, itemDigits, item)
+	if len(body) != g.length-1 {
+		return 0, errCodesExhausted
+	}
+
+	return strconv.ParseUint(body+strconv.Itoa(gtinCheckDigit(body)), 10, 64)
+}
+
+// gtinCheckDigit computes the GS1 check digit: digits are weighted 3 and 1
+// alternately, starting with 3 from the right.
+func gtinCheckDigit(body string) int {
+	sum := 0
+	for i := len(body) - 1; i >= 0; i-- {
+		digit := int(body[i] - '0')
+		if (len(body)-i)%2 == 1 {
+			sum += 3 * digit
+		} else {
+			sum += digit
+		}
+	}
+	return (10 - sum%10) % 10
+}
+
+// newCodeGenerator picks a generator according to STOCK_CODE_GENERATOR,
+// which is one of random (default), sequence, ean13 and upc. The last two
+// take their company prefix from STOCK_CODE_PREFIX.
+func newCodeGenerator() (codeGenerator, error) {
+	kind := os.Getenv("STOCK_CODE_GENERATOR")
+	switch kind {
+	case "", "random":
+		return randomCodeGenerator{}, nil
+	case "sequence":
+		return sequenceCodeGenerator{}, nil
+	case "ean13", "upc":
+		length := 13
+		if kind == "upc" {
+			length = 12
+		}
+
+		prefix := os.Getenv("STOCK_CODE_PREFIX")
+		if strings.Trim(prefix, "0123456789") != "" || len(prefix) >= length-1 {
+			return nil, errors.New("STOCK_CODE_PREFIX should be at most " + strconv.Itoa(length-2) + " digits")
+		}
+		return &gtinCodeGenerator{prefix: prefix, length: length}, nil
+	default:
+		return nil, errors.New("unknown STOCK_CODE_GENERATOR " + kind)
+	}
+}
@@ -0,0 +1,288 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/streadway/amqp"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stock changes are published from the audit stream, which every write
+// appends to in the same transaction, so the stream doubles as an outbox:
+// an entry is acknowledged only after the broker confirms its event.
+const (
+	stocksExchange = "stocks"
+	// consumer group of the audit stream relaying events to the exchange
+	eventsGroup = "events"
+
+	// version of stockEvent, bumped on incompatible changes
+	eventSchemaVersion = 1
+
+	eventsBatchSize = 100
+	eventsBlock     = 5 * time.Second
+	// how long an event may stay unconfirmed by a relay before another one
+	// takes it over
+	eventsClaimIdle = time.Minute
+	eventsRetryWait = time.Second
+
+	// AMQP cuts longer routing keys short without telling
+	maxRoutingKeyLength = 255
+)
+
+var eventTypes = map[string]string{
+	auditCreate: "stock.created",
+	auditUpdate: "stock.updated",
+	auditDelete: "stock.deleted",
+}
+
+// stockEvent is the body of messages published to stocksExchange.
+type stockEvent struct {
+	SchemaVersion int       `json:"schema_version"`
+	Id            string    `json:"id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	Actor         string    `json:"actor"`
+	Code          uint64    `json:"code"`
+	Before        *Stock    `json:"before"`
+	After         *Stock    `json:"after"`
+	// categories the stock had before or has after the change, all of
+	// them, while the routing key may have to leave some out
+	Categories []string `json:"categories"`
+}
+
+var (
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+
+	errNotConfirmed = errors.New("broker did not confirm event")
+)
+
+func newStockEvent(entry auditEntry) (*stockEvent, error) {
+	event := &stockEvent{
+		SchemaVersion: eventSchemaVersion,
+		Id:            entry.Id,
+		Type:          eventTypes[entry.Operation],
+		Time:          entry.Time,
+		Actor:         entry.Actor,
+		Code:          entry.Code,
+	}
+
+	err := json.Unmarshal(entry.Before, &event.Before)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(entry.After, &event.After)
+	if err != nil {
+		return nil, err
+	}
+	event.Categories = event.categories()
+	return event, nil
+}
+
+// categories tells which categories the stock had before or has after the
+// change, sorted.
+func (e *stockEvent) categories() []string {
+	seen := make(map[string]bool)
+	categories := []string{}
+	for _, stock := range []*Stock{e.Before, e.After} {
+		if stock == nil {
+			continue
+		}
+		for _, category := range stock.Categories {
+			if !seen[category] {
+				seen[category] = true
+				categories = append(categories, category)
+			}
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// routingKey is the event type followed by categories the stock had before
+// or has after the change, e.g. stock.updated.food.vegetable, so consumers
+// may bind to things like stock.*.#.vegetable.#. Categories which do not
+// fit into maxRoutingKeyLength are left out, the body has all of them.
+func (e *stockEvent) routingKey() string {
+	key := e.Type
+	added := make(map[string]bool)
+	for _, category := range e.categories() {
+		// dots separate words of a routing key
+		word := strings.ReplaceAll(category, ".", "_")
+		if added[word] || len(key)+1+len(word) > maxRoutingKeyLength {
+			continue
+		}
+		added[word] = true
+		key += "." + word
+	}
+	return key
+}
+
+func publishEvent(event *stockEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	err = ch.Publish(
+		stocksExchange,     // exchange
+		event.routingKey(), // routing key
+		false,              // mandatory
+		false,              // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    event.Id,
+			Type:         event.Type,
+			Timestamp:    event.Time,
+			Body:         body,
+		})
+	if err != nil {
+		return err
+	}
+
+	confirmation, ok := <-confirms
+	if !ok || !confirmation.Ack {
+		return errNotConfirmed
+	}
+	return nil
+}
+
+// setupEvents declares the exchange and the consumer group, and puts the
+// channel into confirm mode.
+func setupEvents(conn *amqp.Connection) error {
+	var err error
+	ch, err = conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	err = ch.ExchangeDeclare(
+		stocksExchange, // name
+		"topic",        // type
+		true,           // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return err
+	}
+	confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	// only changes made from now on are published, not the whole history
+	err = stocksClient.XGroupCreateMkStream(auditStreamKey, eventsGroup, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// relayMessages publishes messages one by one, acknowledging them in the
+// stream, and stops at the first failure to publish.
+func relayMessages(messages []redis.XMessage) error {
+	for _, message := range messages {
+		event, err := newStockEvent(parseAuditEntry(message))
+		if err != nil {
+			// retrying would not help, so the entry is skipped
+			log.Printf("%s %s: %s", "Failed to parse audit entry", message.ID, err)
+		} else {
+			err = publishEvent(event)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = stocksClient.XAck(auditStreamKey, eventsGroup, message.ID).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relayEvents takes over events abandoned by other relays, then publishes
+// own unconfirmed ones and finally new ones.
+func relayEvents(consumer string) error {
+	pending, err := stocksClient.XPendingExt(&redis.XPendingExtArgs{
+		Stream: auditStreamKey,
+		Group:  eventsGroup,
+		Start:  "-",
+		End:    "+",
+		Count:  eventsBatchSize,
+	}).Result()
+	if err != nil {
+		return err
+	}
+
+	var abandoned []string
+	for _, entry := range pending {
+		if entry.Consumer != consumer && entry.Idle >= eventsClaimIdle {
+			abandoned = append(abandoned, entry.ID)
+		}
+	}
+	if len(abandoned) > 0 {
+		_, err = stocksClient.XClaim(&redis.XClaimArgs{
+			Stream:   auditStreamKey,
+			Group:    eventsGroup,
+			Consumer: consumer,
+			MinIdle:  eventsClaimIdle,
+			Messages: abandoned,
+		}).Result()
+		if err != nil {
+			return err
+		}
+	}
+
+	// 0 reads what was delivered to this consumer but not acknowledged yet
+	for _, start := range []string{"0", ">"} {
+		streams, err := stocksClient.XReadGroup(&redis.XReadGroupArgs{
+			Group:    eventsGroup,
+			Consumer: consumer,
+			Streams:  []string{auditStreamKey, start},
+			Count:    eventsBatchSize,
+			Block:    eventsBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, stream := range streams {
+			err = relayMessages(stream.Messages)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func relayEventsForever() {
+	consumer, err := os.Hostname()
+	if err != nil {
+		consumer = "store"
+	}
+
+	for {
+		err := relayEvents(consumer)
+		if err != nil {
+			log.Printf("%s: %s", "Failed to relay stock events", err)
+			time.Sleep(eventsRetryWait)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// +build !solution
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRoutingKeyFitsAmqp(t *testing.T) {
+	var categories []string
+	for i := 0; i < 100; i++ {
+		categories = append(categories, "category"+strings.Repeat("x", i))
+	}
+	event := &stockEvent{
+		Type:   eventTypes[auditUpdate],
+		Before: &Stock{Categories: []string{strings.Repeat("long", 100), "apple"}},
+		After:  &Stock{Categories: categories},
+	}
+
+	key := event.routingKey()
+	if len(key) > maxRoutingKeyLength {
+		t.Fatalf("routing key is %d bytes long", len(key))
+	}
+
+	words := strings.Split(key, ".")
+	if words[0] != "stock" || words[1] != "updated" {
+		t.Fatalf("routing key %s does not start with the event type", key)
+	}
+	known := map[string]bool{"apple": true}
+	for _, category := range categories {
+		known[category] = true
+	}
+	for _, word := range words[2:] {
+		if !known[word] {
+			t.Errorf("routing key has %s, which is not a category", word)
+		}
+	}
+	if !strings.HasPrefix(key, "stock.updated.apple.") {
+		t.Errorf("routing key %s leaves out apple, which fits", key)
+	}
+
+	if len(event.categories()) != len(categories)+2 {
+		t.Errorf("event has %d categories, should have %d", len(event.categories()), len(categories)+2)
+	}
+}
+
+func TestRoutingKeyReplacesDots(t *testing.T) {
+	event := &stockEvent{
+		Type:  eventTypes[auditCreate],
+		After: &Stock{Categories: []string{"food.vegetable", "food"}},
+	}
+
+	key := event.routingKey()
+	if key != "stock.created.food.food_vegetable" {
+		t.Errorf("routing key is %s", key)
+	}
+}
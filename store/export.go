@@ -0,0 +1,199 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	exportCsv   = "csv"
+	exportJsonl = "jsonl"
+	exportJson  = "json"
+)
+
+var exportContentTypes = map[string]string{
+	exportCsv:   "text/csv; charset=utf-8",
+	exportJsonl: "application/x-ndjson",
+	exportJson:  "application/json",
+}
+
+// stockWriter writes stocks of an export one by one. Flush sends whatever
+// is buffered on to the response.
+type stockWriter interface {
+	Write(stock *Stock) error
+	Flush() error
+	Close() error
+}
+
+// csvStockWriter writes rows csv-consumer imports, that is
+// code,name,cat1&cat2&cat3,quantity,12.34 USD. Ampersands and backslashes
+// in categories are escaped with a backslash.
+type csvStockWriter struct {
+	writer *csv.Writer
+}
+
+func (c *csvStockWriter) Write(stock *Stock) error {
+	price := ""
+	if stock.Price != nil {
+		price = formatPrice(stock.Price)
+	}
+
+	return c.writer.Write([]string{
+		strconv.FormatUint(stock.Code, 10),
+		stock.Name,
+		joinCategories(stock.Categories),
+		strconv.FormatUint(stock.Quantity, 10),
+		price,
+	})
+}
+
+var categoryEscaper = strings.NewReplacer(`\`, `\\`, "&", `\&`)
+
+// joinCategories is the reverse of splitCategories in csv-consumer.
+func joinCategories(categories []string) string {
+	escaped := make([]string, len(categories))
+	for i, category := range categories {
+		escaped[i] = categoryEscaper.Replace(category)
+	}
+	return strings.Join(escaped, "&")
+}
+
+func (c *csvStockWriter) Flush() error {
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+func (c *csvStockWriter) Close() error {
+	return c.Flush()
+}
+
+type jsonlStockWriter struct {
+	encoder *json.Encoder
+}
+
+func (j *jsonlStockWriter) Write(stock *Stock) error {
+	return j.encoder.Encode(stock)
+}
+
+func (j *jsonlStockWriter) Flush() error {
+	return nil
+}
+
+func (j *jsonlStockWriter) Close() error {
+	return nil
+}
+
+// jsonStockWriter writes a single array, element by element.
+type jsonStockWriter struct {
+	w       http.ResponseWriter
+	written bool
+}
+
+func (j *jsonStockWriter) Write(stock *Stock) error {
+	separator := ","
+	if !j.written {
+		separator = "["
+		j.written = true
+	}
+
+	contents, err := json.Marshal(stock)
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(append([]byte(separator), contents...))
+	return err
+}
+
+func (j *jsonStockWriter) Flush() error {
+	return nil
+}
+
+func (j *jsonStockWriter) Close() error {
+	end := "]\n"
+	if !j.written {
+		end = "[]\n"
+	}
+	_, err := j.w.Write([]byte(end))
+	return err
+}
+
+func newStockWriter(format string, w http.ResponseWriter) stockWriter {
+	switch format {
+	case exportCsv:
+		return &csvStockWriter{writer: csv.NewWriter(w)}
+	case exportJsonl:
+		return &jsonlStockWriter{encoder: json.NewEncoder(w)}
+	default:
+		return &jsonStockWriter{w: w}
+	}
+}
+
+// exportStocks streams all stocks matching the listing filters, reading
+// them from the database a batch at a time.
+func exportStocks(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(false, w, r.Header) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportCsv
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		util.ErrorAsJson(w, "Bad format, should be csv, jsonl or json", http.StatusBadRequest)
+		return
+	}
+
+	filter, cursor, _, ok := parseListQuery(w, r)
+	if !ok {
+		return
+	}
+
+	// the first batch is read before answering, so that a broken database
+	// still gets a proper error
+	stocks, cursor, err := listStocks(filter, cursor, listBatchSize)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from stocks database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="stocks.`+format+`"`)
+	writer := newStockWriter(format, w)
+	flusher, _ := w.(http.Flusher)
+
+	for {
+		for i := range stocks {
+			err = writer.Write(&stocks[i])
+			if err != nil {
+				return
+			}
+		}
+		err = writer.Flush()
+		if err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if cursor == "" {
+			break
+		}
+		stocks, cursor, err = listStocks(filter, cursor, listBatchSize)
+		if err != nil {
+			// the status is already sent, so a cut off body is all that
+			// tells the client something went wrong
+			return
+		}
+	}
+
+	_ = writer.Close()
+}
@@ -0,0 +1,72 @@
+// +build !solution
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+// categoryCase is a list of categories along with how it is exported.
+// testdata/categories.json has them, csv-consumer reads them back in
+// TestSplitCategories, so that together the tests check that exported
+// categories are imported as they were.
+type categoryCase struct {
+	Categories []string `json:"categories"`
+	Joined     string   `json:"joined"`
+}
+
+func readCategoryCases(t *testing.T, path string) []categoryCase {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases []categoryCase
+	err = json.Unmarshal(contents, &cases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cases
+}
+
+func TestJoinCategories(t *testing.T) {
+	for _, c := range readCategoryCases(t, "testdata/categories.json") {
+		if joined := joinCategories(c.Categories); joined != c.Joined {
+			t.Errorf("joinCategories(%q) = %q, should be %q", c.Categories, joined, c.Joined)
+		}
+	}
+}
+
+// exportedStocks are what testdata/export.csv holds, csv-consumer imports
+// the file in TestParseExportedRecords.
+var exportedStocks = []Stock{
+	{Code: 1, Name: "Carrot", Categories: []string{"food", "vegetable"}, Quantity: 3, Price: &Price{Amount: 1234, Currency: "USD"}},
+	{Code: 2, Name: `Salt, "fine"`, Categories: []string{"salt & pepper", `back\slash`, `ends with \`}},
+	{Code: 3, Name: "Nothing", Categories: []string{}, Quantity: 7, Price: &Price{Amount: 500, Currency: "JPY"}},
+}
+
+func TestCsvExport(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := &csvStockWriter{writer: csv.NewWriter(&buffer)}
+	for i := range exportedStocks {
+		err := writer.Write(&exportedStocks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := ioutil.ReadFile("testdata/export.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != string(expected) {
+		t.Errorf("export is\n%s\nshould be\n%s", buffer.String(), expected)
+	}
+}
@@ -3,9 +3,15 @@ module github.com/ilya-pauzner/dc-store
 go 1.14
 
 require (
+	github.com/evanphx/json-patch v4.9.0+incompatible
 	github.com/go-redis/redis/v7 v7.2.0
 	github.com/gorilla/mux v1.7.4
 	github.com/ilya-pauzner/dc-store/util v0.0.0-20200611140228-03c834b44f6e
 	github.com/ilya-pauzner/dc-store/validator v0.0.0-20200611165522-577cadc635fc
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/streadway/amqp v0.0.0-20200108173154-1c71cc93ed71
 	google.golang.org/grpc v1.29.1
 )
+
+// the validator is built from this repository, see Dockerfile
+replace github.com/ilya-pauzner/dc-store/validator => ../validator
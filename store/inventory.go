@@ -0,0 +1,124 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+)
+
+var errNotEnoughUnits = errors.New("not enough units")
+
+// errUnitsReserved means a stock can not be deleted while orders hold its
+// units, since their orders could be neither shipped nor cancelled then.
+var errUnitsReserved = errors.New("units are reserved")
+
+// inventoryOperation changes unit counts of stock by amount, failing with
+// errNotEnoughUnits if that would make them inconsistent.
+type inventoryOperation func(stock *Stock, amount uint64) error
+
+func incrementUnits(stock *Stock, amount uint64) error {
+	if stock.Quantity+amount < stock.Quantity {
+		return errNotEnoughUnits
+	}
+	stock.Quantity += amount
+	return nil
+}
+
+func decrementUnits(stock *Stock, amount uint64) error {
+	if stock.Quantity-stock.Reserved < amount {
+		return errNotEnoughUnits
+	}
+	stock.Quantity -= amount
+	return nil
+}
+
+func reserveUnits(stock *Stock, amount uint64) error {
+	if stock.Quantity-stock.Reserved < amount {
+		return errNotEnoughUnits
+	}
+	stock.Reserved += amount
+	return nil
+}
+
+func releaseUnits(stock *Stock, amount uint64) error {
+	if stock.Reserved < amount {
+		return errNotEnoughUnits
+	}
+	stock.Reserved -= amount
+	return nil
+}
+
+// shipUnits takes reserved units out of the store for good.
+func shipUnits(stock *Stock, amount uint64) error {
+	if stock.Reserved < amount {
+		return errNotEnoughUnits
+	}
+	stock.Reserved -= amount
+	stock.Quantity -= amount
+	return nil
+}
+
+// answerInventoryError answers with an error matching what updateStock
+// returned, if anything.
+func answerInventoryError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errNotEnoughUnits) {
+		util.ErrorAsJson(w, "Not enough units in stock", http.StatusConflict)
+	} else if errors.Is(err, redis.TxFailedErr) {
+		util.ErrorAsJson(w, "Stock is being modified concurrently, try again", http.StatusConflict)
+	} else if err != nil {
+		_ = answerRedisError(w, "stocks", err)
+	}
+	return err
+}
+
+func changeUnits(operation inventoryOperation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok := validateUserAndAnswer(true, w, r.Header)
+		if !ok {
+			return
+		}
+
+		// because of regex in router, key exists in vars
+		vars := mux.Vars(r)
+		code, err := strconv.ParseUint(vars["code"], 10, 64)
+		if err != nil {
+			util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+			return
+		}
+
+		var data struct {
+			Amount uint64 `json:"amount"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&data)
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to unmarshal request body", http.StatusBadRequest)
+			return
+		}
+		if data.Amount == 0 {
+			util.ErrorAsJson(w, "Failed to get positive amount from request body", http.StatusBadRequest)
+			return
+		}
+
+		stock, err := updateStock(code, actor, func(old *Stock) (*Stock, error) {
+			if old == nil {
+				return nil, redis.Nil
+			}
+			err := operation(old, data.Amount)
+			if err != nil {
+				return nil, err
+			}
+			return old, nil
+		})
+		if answerInventoryError(w, err) != nil {
+			return
+		}
+
+		writeStockResponse(w, stock)
+	}
+}
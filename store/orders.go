@@ -0,0 +1,441 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of keys holding orders by id
+	orderPrefix = "order:"
+	// sorted sets of all order ids and of ids of every user's orders, laid
+	// out as stocksIndexKey
+	ordersIndexKey        = "index:orders"
+	userOrdersIndexPrefix = "index:orders:"
+
+	// how many different stocks a single order may contain
+	maxOrderItems = 100
+)
+
+const (
+	orderPending   = "pending"
+	orderPaid      = "paid"
+	orderShipped   = "shipped"
+	orderCancelled = "cancelled"
+)
+
+// states every state may be reached from
+var orderTransitions = map[string][]string{
+	orderPaid:      {orderPending},
+	orderShipped:   {orderPaid},
+	orderCancelled: {orderPending, orderPaid},
+}
+
+// what happens to reserved units of an order when it reaches a state
+var orderInventoryOperations = map[string]inventoryOperation{
+	orderShipped:   shipUnits,
+	orderCancelled: releaseUnits,
+}
+
+var (
+	errOrderState  = errors.New("order can not reach this state")
+	errOrderExists = errors.New("order already exists")
+)
+
+type OrderItem struct {
+	Code     uint64 `json:"code"`
+	Quantity uint64 `json:"quantity"`
+}
+
+type Order struct {
+	Id        uint64      `json:"id"`
+	Email     string      `json:"email"`
+	Items     []OrderItem `json:"items"`
+	State     string      `json:"state"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+type ordersPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor"`
+}
+
+func orderKey(id uint64) string {
+	return orderPrefix + strconv.FormatUint(id, 10)
+}
+
+func userOrdersIndexKey(email string) string {
+	return userOrdersIndexPrefix + email
+}
+
+func getOrderFrom(c redis.Cmdable, id uint64) (*Order, error) {
+	contents, err := c.Get(orderKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var order Order
+	err = json.Unmarshal([]byte(contents), &order)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func writeOrder(pipe redis.Pipeliner, order *Order) error {
+	contents, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+
+	member := indexMember(order.Id)
+	pipe.Set(orderKey(order.Id), contents, 0)
+	pipe.ZAdd(ordersIndexKey, &redis.Z{Member: member})
+	pipe.ZAdd(userOrdersIndexKey(order.Email), &redis.Z{Member: member})
+	return nil
+}
+
+// applyToOrderStocks atomically applies operation to every stock of order
+// and writes order itself. Missing stocks fail the whole thing with
+// errNoStock unless skipMissing is set.
+func applyToOrderStocks(order *Order, actor string, operation inventoryOperation, skipMissing bool, check func(tx *redis.Tx) error) error {
+	keys := []string{orderKey(order.Id)}
+	for _, item := range order.Items {
+		keys = append(keys, strconv.FormatUint(item.Code, 10))
+	}
+
+	return transaction(keys, func(tx *redis.Tx) error {
+		err := check(tx)
+		if err != nil {
+			return err
+		}
+
+		olds := make([]*Stock, len(order.Items))
+		stocks := make([]*Stock, len(order.Items))
+		for i, item := range order.Items {
+			olds[i], err = getStockFrom(tx, keys[i+1])
+			if err != nil {
+				return err
+			}
+			if olds[i] == nil {
+				if skipMissing {
+					continue
+				}
+				return errNoStock
+			}
+
+			stock := *olds[i]
+			err = operation(&stock, item.Quantity)
+			if err != nil {
+				return err
+			}
+			stocks[i] = &stock
+		}
+
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			for i, item := range order.Items {
+				if stocks[i] == nil {
+					continue
+				}
+				err := writeStock(pipe, item.Code, olds[i], stocks[i], actor)
+				if err != nil {
+					return err
+				}
+			}
+			return writeOrder(pipe, order)
+		})
+		return err
+	})
+}
+
+func listOrders(index string, cursor string, limit int) ([]Order, string, error) {
+	min := "-"
+	if cursor != "" {
+		id, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		min = "(" + indexMember(id)
+	}
+
+	members, err := stocksClient.ZRangeByLex(index, &redis.ZRangeBy{
+		Min:   min,
+		Max:   "+",
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	orders := make([]Order, 0, len(members))
+	if len(members) == 0 {
+		return orders, "", nil
+	}
+
+	keys := make([]string, len(members))
+	for i, member := range members {
+		id, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		keys[i] = orderKey(id)
+	}
+
+	values, err := stocksClient.MGet(keys...).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, value := range values {
+		contents, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var order Order
+		err = json.Unmarshal([]byte(contents), &order)
+		if err != nil {
+			return nil, "", err
+		}
+		orders = append(orders, order)
+	}
+
+	nextCursor := ""
+	if len(members) == limit {
+		nextCursor = strings.TrimPrefix(keys[len(keys)-1], orderPrefix)
+	}
+	return orders, nextCursor, nil
+}
+
+// answerOrderError answers with an error matching what an order operation
+// returned, if anything.
+func answerOrderError(w http.ResponseWriter, err error) error {
+	if errors.Is(err, errNoStock) {
+		util.ErrorAsJson(w, "Order contains a stock which does not exist", http.StatusBadRequest)
+	} else if errors.Is(err, errOrderState) {
+		util.ErrorAsJson(w, "Order can not reach this state", http.StatusConflict)
+	} else if errors.Is(err, errOrderExists) {
+		// ids are random, so trying again gets another one
+		util.ErrorAsJson(w, "Order number collision, try again", http.StatusConflict)
+	} else {
+		return answerInventoryError(w, err)
+	}
+	return err
+}
+
+func createOrder(w http.ResponseWriter, r *http.Request) {
+	email, ok := validateUserAndAnswer(false, w, r.Header)
+	if !ok {
+		return
+	}
+	if email == "" {
+		util.ErrorAsJson(w, "Token is not linked to any email, authorize again", http.StatusForbidden)
+		return
+	}
+
+	var data struct {
+		Items []OrderItem `json:"items"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to unmarshal request body", http.StatusBadRequest)
+		return
+	}
+
+	// the same stock may be mentioned several times, but is reserved once
+	quantities := make(map[uint64]uint64)
+	var items []OrderItem
+	for _, item := range data.Items {
+		if item.Quantity == 0 {
+			util.ErrorAsJson(w, "Every item should have positive quantity", http.StatusBadRequest)
+			return
+		}
+		if _, ok := quantities[item.Code]; !ok {
+			items = append(items, OrderItem{Code: item.Code})
+		}
+		quantities[item.Code] += item.Quantity
+	}
+	if len(items) == 0 || len(items) > maxOrderItems {
+		util.ErrorAsJson(w, "Order should contain between 1 and "+strconv.Itoa(maxOrderItems)+" stocks", http.StatusBadRequest)
+		return
+	}
+	for i := range items {
+		items[i].Quantity = quantities[items[i].Code]
+	}
+
+	now := time.Now().UTC()
+	order := &Order{
+		Id:        util.RandomUint64(),
+		Email:     email,
+		Items:     items,
+		State:     orderPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	err = applyToOrderStocks(order, email, reserveUnits, false, func(tx *redis.Tx) error {
+		exists, err := tx.Exists(orderKey(order.Id)).Result()
+		if err != nil {
+			return err
+		}
+		if exists != 0 {
+			return errOrderExists
+		}
+		return nil
+	})
+	if answerOrderError(w, err) != nil {
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(order)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+// getOwnOrder reads order with id from request path, answering with an
+// error unless it belongs to the caller or the caller is an admin. Caller's
+// email is returned as well.
+func getOwnOrder(w http.ResponseWriter, r *http.Request) (*Order, string, bool) {
+	email, ok := validateUserAndAnswer(false, w, r.Header)
+	if !ok {
+		return nil, "", false
+	}
+
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+	id, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		util.ErrorAsJson(w, "Bad order number", http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	order, err := getOrderFrom(stocksClient, id)
+	if answerRedisError(w, "orders", err) != nil {
+		return nil, "", false
+	}
+
+	if order.Email != email {
+		admin, err := isAdmin(r.Header)
+		if err != nil {
+			util.ErrorAsJson(w, err.Error(), http.StatusInternalServerError)
+			return nil, "", false
+		}
+		if !admin {
+			util.ErrorAsJson(w, "Access denied", http.StatusForbidden)
+			return nil, "", false
+		}
+	}
+
+	return order, email, true
+}
+
+func getOrder(w http.ResponseWriter, r *http.Request) {
+	order, _, ok := getOwnOrder(w, r)
+	if !ok {
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(order)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+func changeOrderState(state string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		order, actor, ok := getOwnOrder(w, r)
+		if !ok {
+			return
+		}
+
+		// only admins take payments and ship orders
+		if (state == orderPaid || state == orderShipped) && !validateAndAnswer(true, w, r.Header) {
+			return
+		}
+
+		operation, ok := orderInventoryOperations[state]
+		if !ok {
+			operation = func(*Stock, uint64) error { return nil }
+		}
+
+		err := applyToOrderStocks(order, actor, operation, true, func(tx *redis.Tx) error {
+			current, err := getOrderFrom(tx, order.Id)
+			if err != nil {
+				return err
+			}
+
+			allowed := false
+			for _, from := range orderTransitions[state] {
+				if current.State == from {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return errOrderState
+			}
+
+			order.State = state
+			order.UpdatedAt = time.Now().UTC()
+			return nil
+		})
+		if answerOrderError(w, err) != nil {
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(order)
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func answerOrders(w http.ResponseWriter, r *http.Request, index string) {
+	cursor, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	orders, nextCursor, err := listOrders(index, cursor, limit)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from orders database", http.StatusInternalServerError)
+		return
+	}
+
+	err = json.NewEncoder(w).Encode(ordersPage{Orders: orders, NextCursor: nextCursor})
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+func getOrders(w http.ResponseWriter, r *http.Request) {
+	email, ok := validateUserAndAnswer(false, w, r.Header)
+	if !ok {
+		return
+	}
+
+	answerOrders(w, r, userOrdersIndexKey(email))
+}
+
+func getAllOrders(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	answerOrders(w, r, ordersIndexKey)
+}
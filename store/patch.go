@@ -0,0 +1,136 @@
+// +build !solution
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// errBadPatch wraps everything wrong with a patch or its result.
+var errBadPatch = errors.New("patch can not be applied")
+
+type patchError struct {
+	reason string
+}
+
+func (e *patchError) Error() string {
+	return e.reason
+}
+
+func (e *patchError) Unwrap() error {
+	return errBadPatch
+}
+
+// applyPatch applies patch of contentType to old, checking the result is
+// still a valid stock.
+func applyPatch(old *Stock, contentType string, patch []byte) (*Stock, error) {
+	document, err := json.Marshal(old)
+	if err != nil {
+		return nil, err
+	}
+
+	switch contentType {
+	case mergePatchContentType:
+		document, err = jsonpatch.MergePatch(document, patch)
+	case jsonPatchContentType:
+		var operations jsonpatch.Patch
+		operations, err = jsonpatch.DecodePatch(patch)
+		if err == nil {
+			document, err = operations.Apply(document)
+		}
+	}
+	if err != nil {
+		return nil, &patchError{reason: err.Error()}
+	}
+
+	var stock Stock
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&stock)
+	if err != nil {
+		return nil, &patchError{reason: "patched stock is malformed: " + err.Error()}
+	}
+
+	err = validatePrice(stock.Price)
+	if err != nil {
+		return nil, &patchError{reason: err.Error()}
+	}
+	if stock.Code != old.Code {
+		return nil, &patchError{reason: "code can not be patched"}
+	}
+	if stock.Reserved != old.Reserved {
+		return nil, &patchError{reason: "reserved units can only be changed through the inventory endpoints"}
+	}
+	if stock.Quantity < stock.Reserved {
+		return nil, errNotEnoughUnits
+	}
+
+	return &stock, nil
+}
+
+func patchStock(w http.ResponseWriter, r *http.Request) {
+	actor, ok := validateUserAndAnswer(true, w, r.Header)
+	if !ok {
+		return
+	}
+
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+	code, err := strconv.ParseUint(vars["code"], 10, 64)
+	if err != nil {
+		util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+		return
+	}
+
+	contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (contentType != mergePatchContentType && contentType != jsonPatchContentType) {
+		util.ErrorAsJson(w, "Content-Type should be "+mergePatchContentType+" or "+jsonPatchContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	stock, err := updateStock(code, actor, func(old *Stock) (*Stock, error) {
+		err := checkIfMatch(r.Header, old)
+		if err != nil {
+			return nil, err
+		}
+		if old == nil {
+			return nil, redis.Nil
+		}
+		return applyPatch(old, contentType, patch)
+	})
+	if errors.Is(err, errBadPatch) {
+		util.ErrorAsJson(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	} else if errors.Is(err, errNotEnoughUnits) {
+		util.ErrorAsJson(w, "Quantity can not be less than reserved units", http.StatusConflict)
+		return
+	} else if errors.Is(err, errPreconditionFailed) {
+		util.ErrorAsJson(w, "Stock version does not match If-Match", http.StatusPreconditionFailed)
+		return
+	} else if answerRedisError(w, "stocks", err) != nil {
+		return
+	}
+
+	writeStockResponse(w, stock)
+}
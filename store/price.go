@@ -0,0 +1,151 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of per-stock lists of past prices, newest first
+	priceHistoryPrefix = "history:price:"
+	// how many past prices are kept for every stock
+	maxPriceHistory = 1000
+)
+
+// Price is an exact amount of money in minor units of Currency, e.g. cents
+// for USD. Currency is an ISO 4217 alphabetic code.
+type Price struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+type priceChange struct {
+	Price     *Price    `json:"price"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+var currencyRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// currencies with other than two digits after the decimal point, the same
+// table csv-consumer parses prices with
+var currencyExponents = map[string]int{
+	"BHD": 3, "BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "IQD": 3, "ISK": 0,
+	"JOD": 3, "JPY": 0, "KMF": 0, "KRW": 0, "KWD": 3, "LYD": 3, "OMR": 3,
+	"PYG": 0, "RWF": 0, "TND": 3, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0,
+	"XOF": 0, "XPF": 0,
+}
+
+func priceHistoryKey(code uint64) string {
+	return priceHistoryPrefix + strconv.FormatUint(code, 10)
+}
+
+func validatePrice(price *Price) error {
+	if price == nil {
+		return nil
+	}
+	if price.Amount < 0 {
+		return errors.New("price amount can not be negative")
+	}
+	if !currencyRegexp.MatchString(price.Currency) {
+		return errors.New("price currency should be an ISO 4217 code")
+	}
+	return nil
+}
+
+// formatPrice formats price as a decimal amount followed by a currency code,
+// e.g. 12.34 USD, which is what csv-consumer accepts.
+func formatPrice(price *Price) string {
+	exponent, ok := currencyExponents[price.Currency]
+	if !ok {
+		exponent = 2
+	}
+
+	digits := strconv.FormatInt(price.Amount, 10)
+	if exponent == 0 {
+		return digits + " " + price.Currency
+	}
+	if len(digits) <= exponent {
+		digits = strings.Repeat("0", exponent-len(digits)+1) + digits
+	}
+	whole, fraction := digits[:len(digits)-exponent], digits[len(digits)-exponent:]
+	return whole + "." + fraction + " " + price.Currency
+}
+
+func samePrice(a *Price, b *Price) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// recordPrice queues commands remembering the price of stock if it differs
+// from the one of old. Deleted stocks keep their history until they are
+// purged from the trash.
+func recordPrice(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock) error {
+	key := priceHistoryKey(code)
+
+	if stock == nil {
+		return nil
+	}
+
+	var oldPrice *Price
+	if old != nil {
+		oldPrice = old.Price
+	}
+	if samePrice(oldPrice, stock.Price) {
+		return nil
+	}
+
+	contents, err := json.Marshal(priceChange{Price: stock.Price, ChangedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	pipe.LPush(key, contents)
+	pipe.LTrim(key, 0, maxPriceHistory-1)
+	return nil
+}
+
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(false, w, r.Header) {
+		return
+	}
+
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+	code, err := strconv.ParseUint(vars["code"], 10, 64)
+	if err != nil {
+		util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+		return
+	}
+
+	values, err := stocksClient.LRange(priceHistoryKey(code), 0, -1).Result()
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from prices database", http.StatusInternalServerError)
+		return
+	}
+
+	changes := make([]priceChange, len(values))
+	for i, value := range values {
+		err = json.Unmarshal([]byte(value), &changes[i])
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to unmarshal data from database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(changes)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,160 @@
+// +build !solution
+
+package main
+
+import (
+	"github.com/go-redis/redis/v7"
+	"github.com/ilya-pauzner/dc-store/util"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Search index: every token of a stock's name and categories points to a
+// sorted set of padded stock codes, scored by where the token was found.
+const (
+	// lexicographically sorted set of all tokens, used for prefix lookups
+	tokensIndexKey = "index:tokens"
+	// prefix of per-token sorted sets
+	tokenIndexPrefix = "index:token:"
+	// prefix of temporary keys holding intermediate search results
+	searchTempPrefix = "tmp:search:"
+
+	nameTokenWeight     = 2
+	categoryTokenWeight = 1
+	// query terms matching only the beginning of a token count for less
+	prefixMatchWeight = 0.5
+	// how many tokens a single query term may expand to
+	maxPrefixExpansions = 50
+)
+
+func tokenIndexKey(token string) string {
+	return tokenIndexPrefix + token
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// stockTokens maps every token of stock to its weight.
+func stockTokens(stock *Stock) map[string]float64 {
+	tokens := make(map[string]float64)
+	if stock == nil {
+		return tokens
+	}
+
+	for _, token := range tokenize(stock.Name) {
+		tokens[token] = nameTokenWeight
+	}
+	for _, category := range stock.Categories {
+		for _, token := range tokenize(category) {
+			if _, ok := tokens[token]; !ok {
+				tokens[token] = categoryTokenWeight
+			}
+		}
+	}
+	return tokens
+}
+
+// indexStockTokens queues commands moving member in the search index from
+// the tokens of old to the tokens of stock. Either of them may be nil.
+func indexStockTokens(pipe redis.Pipeliner, member string, old *Stock, stock *Stock) {
+	oldTokens := stockTokens(old)
+	newTokens := stockTokens(stock)
+
+	for token, weight := range newTokens {
+		if oldWeight, ok := oldTokens[token]; !ok || oldWeight != weight {
+			pipe.ZAdd(tokenIndexKey(token), &redis.Z{Score: weight, Member: member})
+			pipe.ZAdd(tokensIndexKey, &redis.Z{Member: token})
+		}
+	}
+	for token := range oldTokens {
+		if _, ok := newTokens[token]; !ok {
+			pipe.Eval(removeFromIndexScript, []string{tokenIndexKey(token), tokensIndexKey}, member, token)
+		}
+	}
+}
+
+// searchStocks returns stocks matching every term of query, best first,
+// skipping offset of them. Terms match whole tokens as well as their
+// beginnings. Returned offset is 0 when there are no more results.
+func searchStocks(query string, offset int64, limit int64) ([]Stock, int64, error) {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return []Stock{}, 0, nil
+	}
+
+	// expand every term to the tokens it is a prefix of
+	expansions := make([][]string, len(terms))
+	for i, term := range terms {
+		tokens, err := stocksClient.ZRangeByLex(tokensIndexKey, &redis.ZRangeBy{
+			Min:   "[" + term,
+			Max:   "[" + term + "\xff",
+			Count: maxPrefixExpansions,
+		}).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(tokens) == 0 {
+			return []Stock{}, 0, nil
+		}
+		expansions[i] = tokens
+	}
+
+	tempPrefix := searchTempPrefix + strconv.FormatUint(util.RandomUint64(), 10) + ":"
+	termKeys := make([]string, len(terms))
+	resultKey := tempPrefix + "result"
+
+	var membersCmd *redis.StringSliceCmd
+	_, err := stocksClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, term := range terms {
+			store := &redis.ZStore{Aggregate: "MAX"}
+			for _, token := range expansions[i] {
+				store.Keys = append(store.Keys, tokenIndexKey(token))
+				if token == term {
+					store.Weights = append(store.Weights, 1)
+				} else {
+					store.Weights = append(store.Weights, prefixMatchWeight)
+				}
+			}
+			termKeys[i] = tempPrefix + strconv.Itoa(i)
+			pipe.ZUnionStore(termKeys[i], store)
+		}
+
+		pipe.ZInterStore(resultKey, &redis.ZStore{Keys: termKeys, Aggregate: "SUM"})
+		// one extra to know whether there is a next page
+		membersCmd = pipe.ZRevRange(resultKey, offset, offset+limit)
+		pipe.Del(append(termKeys, resultKey)...)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	members := membersCmd.Val()
+	nextOffset := int64(0)
+	if int64(len(members)) > limit {
+		members = members[:limit]
+		nextOffset = offset + limit
+	}
+	if len(members) == 0 {
+		return []Stock{}, 0, nil
+	}
+
+	keys := make([]string, len(members))
+	for i, member := range members {
+		code, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		keys[i] = strconv.FormatUint(code, 10)
+	}
+
+	stocks, err := getStocks(keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	return stocks, nextOffset, nil
+}
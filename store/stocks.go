@@ -0,0 +1,554 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"strconv"
+	"strings"
+)
+
+// Stocks live in the database under their decimal code. Everything else
+// stored next to them uses non-numeric keys, so the two never clash.
+const (
+	// sorted set of all stock codes, every member has score 0 and is
+	// zero-padded, so lexicographical order is the numerical one
+	stocksIndexKey = "index:stocks"
+	// lexicographically sorted set of all category names in use
+	categoriesIndexKey = "index:categories"
+	// prefix of per-category sorted sets, laid out as stocksIndexKey
+	categoryIndexPrefix = "index:category:"
+
+	// how many index entries are fetched from redis at once
+	listBatchSize = 100
+	// how many stocks a single listing request may look at before it
+	// gives up and returns a partial page together with a cursor
+	listScanLimit = 5000
+	// how many times a transaction is retried when a watched key changes
+	maxTxRetries = 10
+)
+
+// removes a stock from a category or search token index, dropping the
+// index name from the list of names once nothing is left in it
+var removeFromIndexScript = `
+redis.call('ZREM', KEYS[1], ARGV[1])
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	redis.call('ZREM', KEYS[2], ARGV[2])
+end
+return 0
+`
+
+func indexMember(code uint64) string {
+	return fmt.Sprintf("%020d", code)
+}
+
+func categoryIndexKey(category string) string {
+	return categoryIndexPrefix + category
+}
+
+func getStockFrom(c redis.Cmdable, key string) (*Stock, error) {
+	contents, err := c.Get(key).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stock Stock
+	err = json.Unmarshal([]byte(contents), &stock)
+	if err != nil {
+		return nil, err
+	}
+	return &stock, nil
+}
+
+// getStocks returns stocks stored under keys in the same order, skipping
+// the ones that do not exist.
+func getStocks(keys []string) ([]Stock, error) {
+	values, err := stocksClient.MGet(keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stocks := make([]Stock, 0, len(values))
+	for _, value := range values {
+		contents, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		var stock Stock
+		err = json.Unmarshal([]byte(contents), &stock)
+		if err != nil {
+			return nil, err
+		}
+		stocks = append(stocks, stock)
+	}
+	return stocks, nil
+}
+
+// writeStock queues commands replacing old with stock under code, including
+// index maintenance. Either of them may be nil, deleted stocks go to the
+// trash. Version of stock is set to follow the one of old.
+func writeStock(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock, actor string) error {
+	return writeStockAfter(pipe, code, old, old, stock, actor)
+}
+
+// writeStockAfter is writeStock for a stock whose last version is previous
+// rather than old, which is the case for stocks restored from the trash.
+// Version and price history of stock follow previous, so that ETags are
+// never reused.
+func writeStockAfter(pipe redis.Pipeliner, code uint64, old *Stock, previous *Stock, stock *Stock, actor string) error {
+	key := strconv.FormatUint(code, 10)
+
+	if stock == nil {
+		pipe.Del(key)
+		if old != nil {
+			err := trashStock(pipe, old, actor)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		stock.Version = 1
+		if previous != nil {
+			stock.Version = previous.Version + 1
+		}
+
+		contents, err := json.Marshal(stock)
+		if err != nil {
+			return err
+		}
+		pipe.Set(key, contents, 0)
+	}
+
+	indexStock(pipe, code, old, stock)
+
+	err := recordPrice(pipe, code, previous, stock)
+	if err != nil {
+		return err
+	}
+	return recordAudit(pipe, code, old, stock, actor)
+}
+
+// indexStock queues commands moving code in the indexes from where old
+// belongs to where stock belongs. Either of them may be nil.
+func indexStock(pipe redis.Pipeliner, code uint64, old *Stock, stock *Stock) {
+	member := indexMember(code)
+
+	if stock == nil {
+		pipe.ZRem(stocksIndexKey, member)
+	} else {
+		pipe.ZAdd(stocksIndexKey, &redis.Z{Member: member})
+	}
+
+	oldCategories := make(map[string]bool)
+	if old != nil {
+		for _, category := range old.Categories {
+			oldCategories[category] = true
+		}
+	}
+	newCategories := make(map[string]bool)
+	if stock != nil {
+		for _, category := range stock.Categories {
+			newCategories[category] = true
+		}
+	}
+
+	for category := range newCategories {
+		if !oldCategories[category] {
+			pipe.ZAdd(categoryIndexKey(category), &redis.Z{Member: member})
+			pipe.ZAdd(categoriesIndexKey, &redis.Z{Member: category})
+		}
+	}
+	for category := range oldCategories {
+		if !newCategories[category] {
+			pipe.Eval(removeFromIndexScript, []string{categoryIndexKey(category), categoriesIndexKey}, member, category)
+		}
+	}
+
+	indexStockTokens(pipe, member, old, stock)
+}
+
+// updateStock atomically replaces the stock stored under code with the
+// result of update, keeping the indexes in sync. update gets nil when there
+// is no such stock, and returning nil from it deletes the stock. Errors
+// returned by update are passed through untouched.
+func updateStock(code uint64, actor string, update func(old *Stock) (*Stock, error)) (*Stock, error) {
+	key := strconv.FormatUint(code, 10)
+
+	var stock *Stock
+	txf := func(tx *redis.Tx) error {
+		old, err := getStockFrom(tx, key)
+		if err != nil {
+			return err
+		}
+
+		stock, err = update(old)
+		if err != nil {
+			return err
+		}
+		previous, err := lastVersionOf(tx, code, old)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			return writeStockAfter(pipe, code, old, previous, stock, actor)
+		})
+		return err
+	}
+
+	err := transaction([]string{key}, txf)
+	if err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// stockUpdate is a single change for updateStocks, see updateStock.
+type stockUpdate struct {
+	Code   uint64
+	Update func(old *Stock) (*Stock, error)
+	// set for creations, makes the same update under a new code if Code
+	// turns out to be taken
+	Recreate func() (stockUpdate, error)
+}
+
+// updateStocks applies updates one after another in a single transaction,
+// so an update sees the results of the previous ones. Errors of individual
+// updates go to errs and their writes are skipped, unless atomic is set:
+// then any of them prevents all writes and errBatchFailed is returned.
+func updateStocks(updates []stockUpdate, atomic bool, actor string) ([]*Stock, []error, error) {
+	keys := make([]string, len(updates))
+	for i, update := range updates {
+		keys[i] = strconv.FormatUint(update.Code, 10)
+	}
+
+	var stocks []*Stock
+	var errs []error
+	txf := func(tx *redis.Tx) error {
+		values, err := tx.MGet(keys...).Result()
+		if err != nil {
+			return err
+		}
+
+		current := make(map[uint64]*Stock)
+		for i, value := range values {
+			if contents, ok := value.(string); ok {
+				var stock Stock
+				err = json.Unmarshal([]byte(contents), &stock)
+				if err != nil {
+					return err
+				}
+				current[updates[i].Code] = &stock
+			}
+		}
+
+		stocks = make([]*Stock, len(updates))
+		errs = make([]error, len(updates))
+		olds := make([]*Stock, len(updates))
+		previous := make([]*Stock, len(updates))
+		// last versions of stocks, deleted ones included
+		latest := make(map[uint64]*Stock)
+		failed := false
+		for i, update := range updates {
+			olds[i] = current[update.Code]
+			if last, ok := latest[update.Code]; ok {
+				previous[i] = last
+			} else {
+				previous[i], err = lastVersionOf(tx, update.Code, olds[i])
+				if err != nil {
+					return err
+				}
+			}
+
+			var old *Stock
+			if olds[i] != nil {
+				// updates may modify what they get
+				copied := *olds[i]
+				old = &copied
+			}
+
+			stocks[i], errs[i] = update.Update(old)
+			if errs[i] != nil {
+				failed = true
+				continue
+			}
+			if stocks[i] != nil {
+				// let writeStock assign the version the stock will have
+				copied := *stocks[i]
+				stocks[i] = &copied
+			}
+			current[update.Code] = stocks[i]
+			latest[update.Code] = previous[i]
+			if stocks[i] != nil {
+				latest[update.Code] = stocks[i]
+			}
+		}
+		if failed && atomic {
+			return errBatchFailed
+		}
+
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			for i, update := range updates {
+				if errs[i] != nil {
+					continue
+				}
+				err := writeStockAfter(pipe, update.Code, olds[i], previous[i], stocks[i], actor)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return err
+	}
+
+	err := transaction(keys, txf)
+	return stocks, errs, err
+}
+
+// transaction runs fn with keys watched, retrying it when any of them is
+// changed by someone else before fn commits through tx.TxPipelined.
+func transaction(keys []string, fn func(tx *redis.Tx) error) error {
+	for i := 0; i < maxTxRetries; i++ {
+		err := stocksClient.Watch(fn, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return err
+	}
+	return redis.TxFailedErr
+}
+
+type stockFilter struct {
+	Category   string
+	NamePrefix string
+	// price bounds in minor units, stocks without a price never match them
+	MinPrice *int64
+	MaxPrice *int64
+	Currency string
+}
+
+func (f *stockFilter) matches(stock *Stock) bool {
+	if f.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(stock.Name), strings.ToLower(f.NamePrefix)) {
+		return false
+	}
+	if f.Category != "" {
+		found := false
+		for _, category := range stock.Categories {
+			if category == f.Category {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinPrice != nil || f.MaxPrice != nil || f.Currency != "" {
+		if stock.Price == nil {
+			return false
+		}
+		if f.Currency != "" && stock.Price.Currency != f.Currency {
+			return false
+		}
+		if f.MinPrice != nil && stock.Price.Amount < *f.MinPrice {
+			return false
+		}
+		if f.MaxPrice != nil && stock.Price.Amount > *f.MaxPrice {
+			return false
+		}
+	}
+	return true
+}
+
+// listStocks walks an index in code order, starting right after cursor
+// (empty cursor means from the beginning), and returns up to limit stocks
+// accepted by filter. Returned cursor is empty when the index is exhausted.
+func listStocks(filter *stockFilter, cursor string, limit int) ([]Stock, string, error) {
+	min := "-"
+	if cursor != "" {
+		code, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		min = "(" + indexMember(code)
+	}
+
+	index := stocksIndexKey
+	if filter.Category != "" {
+		index = categoryIndexKey(filter.Category)
+	}
+
+	stocks := make([]Stock, 0, limit)
+	scanned := 0
+	for scanned < listScanLimit {
+		members, err := stocksClient.ZRangeByLex(index, &redis.ZRangeBy{
+			Min:   min,
+			Max:   "+",
+			Count: listBatchSize,
+		}).Result()
+		if err != nil {
+			return nil, "", err
+		}
+		if len(members) == 0 {
+			return stocks, "", nil
+		}
+
+		keys := make([]string, len(members))
+		for i, member := range members {
+			code, err := strconv.ParseUint(member, 10, 64)
+			if err != nil {
+				return nil, "", err
+			}
+			keys[i] = strconv.FormatUint(code, 10)
+		}
+
+		values, err := stocksClient.MGet(keys...).Result()
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i, value := range values {
+			scanned++
+			min = "(" + members[i]
+			cursor = keys[i]
+
+			contents, ok := value.(string)
+			if !ok {
+				// index entry outlived the stock itself
+				continue
+			}
+
+			var stock Stock
+			err = json.Unmarshal([]byte(contents), &stock)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if !filter.matches(&stock) {
+				continue
+			}
+
+			stocks = append(stocks, stock)
+			if len(stocks) == limit {
+				return stocks, cursor, nil
+			}
+		}
+
+		if len(members) < listBatchSize {
+			return stocks, "", nil
+		}
+	}
+
+	return stocks, cursor, nil
+}
+
+type categoryCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// listCategories returns all categories in use, sorted by name.
+func listCategories() ([]categoryCount, error) {
+	names, err := stocksClient.ZRangeByLex(categoriesIndexKey, &redis.ZRangeBy{Min: "-", Max: "+"}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := stocksClient.Pipeline()
+	cmds := make([]*redis.IntCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.ZCard(categoryIndexKey(name))
+	}
+	if len(names) > 0 {
+		_, err = pipe.Exec()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	categories := make([]categoryCount, 0, len(names))
+	for i, name := range names {
+		if count := cmds[i].Val(); count > 0 {
+			categories = append(categories, categoryCount{Name: name, Count: count})
+		}
+	}
+	return categories, nil
+}
+
+// stockCode tells which code key is the stock of, failing for keys which
+// are not stocks, such as those merely starting with a digit.
+func stockCode(key string) (uint64, bool) {
+	code, err := strconv.ParseUint(key, 10, 64)
+	if err != nil || strconv.FormatUint(code, 10) != key {
+		return 0, false
+	}
+	return code, true
+}
+
+// indexExistingStocks adds stocks written before the indexes existed to
+// them. All index writes are idempotent, so running it on every start is
+// harmless.
+func indexExistingStocks() error {
+	var cursor uint64
+	for {
+		// the pattern only narrows keys down to those starting with a digit
+		found, next, err := stocksClient.Scan(cursor, "[0-9]*", listBatchSize).Result()
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		for _, key := range found {
+			if _, ok := stockCode(key); ok {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			err = indexKeys(keys)
+			if err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func indexKeys(keys []string) error {
+	values, err := stocksClient.MGet(keys...).Result()
+	if err != nil {
+		return err
+	}
+
+	_, err = stocksClient.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i, value := range values {
+			code, ok := stockCode(keys[i])
+			if !ok {
+				continue
+			}
+			contents, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			var stock Stock
+			err = json.Unmarshal([]byte(contents), &stock)
+			if err != nil {
+				return err
+			}
+			indexStock(pipe, code, nil, &stock)
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,282 @@
+// +build !solution
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/gorilla/mux"
+	"github.com/ilya-pauzner/dc-store/util"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// prefix of keys holding deleted stocks by code
+	trashPrefix = "trash:"
+	// sorted set of codes of deleted stocks scored by deletion time
+	trashIndexKey = "index:trash"
+
+	defaultTrashRetention = 30 * 24 * time.Hour
+	trashPurgeInterval    = time.Hour
+)
+
+// tombstone is what is left of a deleted stock until it is purged.
+type tombstone struct {
+	Stock     *Stock    `json:"stock"`
+	DeletedAt time.Time `json:"deleted_at"`
+	DeletedBy string    `json:"deleted_by"`
+}
+
+type trashPage struct {
+	Tombstones []tombstone `json:"tombstones"`
+	NextCursor string      `json:"next_cursor"`
+}
+
+func trashKey(code uint64) string {
+	return trashPrefix + strconv.FormatUint(code, 10)
+}
+
+// trashStock queues commands putting a deleted stock into the trash.
+func trashStock(pipe redis.Pipeliner, stock *Stock, actor string) error {
+	now := time.Now().UTC()
+	contents, err := json.Marshal(tombstone{Stock: stock, DeletedAt: now, DeletedBy: actor})
+	if err != nil {
+		return err
+	}
+
+	pipe.Set(trashKey(stock.Code), contents, 0)
+	pipe.ZAdd(trashIndexKey, &redis.Z{Score: float64(now.Unix()), Member: strconv.FormatUint(stock.Code, 10)})
+	return nil
+}
+
+func getTombstoneFrom(c redis.Cmdable, code uint64) (*tombstone, error) {
+	contents, err := c.Get(trashKey(code)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted tombstone
+	err = json.Unmarshal([]byte(contents), &deleted)
+	if err != nil {
+		return nil, err
+	}
+	return &deleted, nil
+}
+
+// lastVersionOf tells what the last version of the stock under code is:
+// old, or the one in the trash if old is nil, so that a stock created again
+// under a code does not reuse ETags of the deleted one.
+func lastVersionOf(c redis.Cmdable, code uint64, old *Stock) (*Stock, error) {
+	if old != nil {
+		return old, nil
+	}
+
+	deleted, err := getTombstoneFrom(c, code)
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return deleted.Stock, nil
+}
+
+// restoreStock atomically moves a stock from the trash back to the
+// catalog, unless its code is taken again by now.
+func restoreStock(code uint64, actor string) (*Stock, error) {
+	key := strconv.FormatUint(code, 10)
+
+	var stock *Stock
+	err := transaction([]string{key, trashKey(code)}, func(tx *redis.Tx) error {
+		deleted, err := getTombstoneFrom(tx, code)
+		if err != nil {
+			return err
+		}
+
+		existing, err := getStockFrom(tx, key)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errStockExists
+		}
+
+		restored := *deleted.Stock
+		stock = &restored
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(trashKey(code))
+			pipe.ZRem(trashIndexKey, key)
+			return writeStockAfter(pipe, code, nil, deleted.Stock, stock, actor)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stock, nil
+}
+
+// trashRetention reads how long deleted stocks are kept from
+// STOCK_TRASH_RETENTION, e.g. 720h.
+func trashRetention() (time.Duration, error) {
+	value := os.Getenv("STOCK_TRASH_RETENTION")
+	if value == "" {
+		return defaultTrashRetention, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// purgeTrash forgets stocks deleted longer than retention ago for good.
+func purgeTrash(retention time.Duration) error {
+	deadline := time.Now().Add(-retention).Unix()
+	for {
+		members, err := stocksClient.ZRangeByScore(trashIndexKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(deadline, 10),
+			Count: listBatchSize,
+		}).Result()
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+
+		// price history belongs to a stock created with the same code since,
+		// if there is one
+		err = transaction(members, func(tx *redis.Tx) error {
+			exists := make([]*redis.IntCmd, len(members))
+			_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+				for i, member := range members {
+					exists[i] = pipe.Exists(member)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+				for i, member := range members {
+					pipe.Del(trashPrefix + member)
+					if exists[i].Val() == 0 {
+						pipe.Del(priceHistoryPrefix + member)
+					}
+					pipe.ZRem(trashIndexKey, member)
+				}
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("purged %d stocks from trash", len(members))
+	}
+}
+
+func purgeTrashForever(retention time.Duration) {
+	for range time.Tick(trashPurgeInterval) {
+		err := purgeTrash(retention)
+		if err != nil {
+			log.Printf("%s: %s", "Failed to purge trash", err)
+		}
+	}
+}
+
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	if !validateAndAnswer(true, w, r.Header) {
+		return
+	}
+
+	_, limit, ok := parsePageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	// trash is ordered by deletion time, newest first, so the cursor is
+	// just an offset into it
+	var offset int64
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		var err error
+		offset, err = strconv.ParseInt(cursor, 10, 64)
+		if err != nil || offset < 0 {
+			util.ErrorAsJson(w, "Bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	members, err := stocksClient.ZRevRange(trashIndexKey, offset, offset+int64(limit)-1).Result()
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to get from trash database", http.StatusInternalServerError)
+		return
+	}
+
+	page := trashPage{Tombstones: make([]tombstone, 0, len(members))}
+	if len(members) == limit {
+		page.NextCursor = strconv.FormatInt(offset+int64(limit), 10)
+	}
+
+	if len(members) > 0 {
+		keys := make([]string, len(members))
+		for i, member := range members {
+			keys[i] = trashPrefix + member
+		}
+
+		values, err := stocksClient.MGet(keys...).Result()
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to get from trash database", http.StatusInternalServerError)
+			return
+		}
+
+		for _, value := range values {
+			contents, ok := value.(string)
+			if !ok {
+				continue
+			}
+
+			var deleted tombstone
+			err = json.Unmarshal([]byte(contents), &deleted)
+			if err != nil {
+				util.ErrorAsJson(w, "Failed to unmarshal data from database", http.StatusInternalServerError)
+				return
+			}
+			page.Tombstones = append(page.Tombstones, deleted)
+		}
+	}
+
+	err = json.NewEncoder(w).Encode(page)
+	if err != nil {
+		util.ErrorAsJson(w, "Failed to marshal response body", http.StatusInternalServerError)
+		return
+	}
+}
+
+func restoreTrashedStock(w http.ResponseWriter, r *http.Request) {
+	actor, ok := validateUserAndAnswer(true, w, r.Header)
+	if !ok {
+		return
+	}
+
+	// because of regex in router, key exists in vars
+	vars := mux.Vars(r)
+	code, err := strconv.ParseUint(vars["code"], 10, 64)
+	if err != nil {
+		util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+		return
+	}
+
+	stock, err := restoreStock(code, actor)
+	if errors.Is(err, errStockExists) {
+		util.ErrorAsJson(w, "Stock with this code exists again, delete it first", http.StatusConflict)
+		return
+	} else if answerRedisError(w, "trash", err) != nil {
+		return
+	}
+
+	writeStockResponse(w, stock)
+}
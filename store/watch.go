@@ -0,0 +1,230 @@
+// +build !solution
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v7"
+	"github.com/ilya-pauzner/dc-store/util"
+	pb "github.com/ilya-pauzner/dc-store/validator"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// every watcher blocks a connection of watchClient, so there are at most
+	// that many of them
+	maxWatchers = 100
+
+	watchBatchSize = 100
+	// how long a read waits for changes before a keep-alive comment is sent
+	watchBlock = 15 * time.Second
+	// how often the token of a watcher is validated again
+	watchRevalidateInterval = time.Minute
+)
+
+var (
+	// separate from stocksClient, so watchers do not starve other handlers
+	watchClient *redis.Client
+	watchers    = make(chan struct{}, maxWatchers)
+)
+
+// watchFilter limits changes sent to a watcher to some codes and categories,
+// a change matching either is sent. Empty filter matches everything.
+type watchFilter struct {
+	Codes      map[uint64]bool
+	Categories map[string]bool
+}
+
+func (f *watchFilter) matches(event *stockEvent) bool {
+	if len(f.Codes) == 0 && len(f.Categories) == 0 {
+		return true
+	}
+	if f.Codes[event.Code] {
+		return true
+	}
+	for _, stock := range []*Stock{event.Before, event.After} {
+		if stock == nil {
+			continue
+		}
+		for _, category := range stock.Categories {
+			if f.Categories[category] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseWatchFilter(w http.ResponseWriter, r *http.Request) (*watchFilter, bool) {
+	query := r.URL.Query()
+	filter := &watchFilter{Codes: make(map[uint64]bool), Categories: make(map[string]bool)}
+
+	if codesString := query.Get("codes"); codesString != "" {
+		for _, codeString := range strings.Split(codesString, ",") {
+			code, err := strconv.ParseUint(codeString, 10, 64)
+			if err != nil {
+				util.ErrorAsJson(w, "Bad stock number", http.StatusBadRequest)
+				return nil, false
+			}
+			filter.Codes[code] = true
+		}
+	}
+	if categories := query.Get("categories"); categories != "" {
+		for _, category := range strings.Split(categories, ",") {
+			filter.Categories[category] = true
+		}
+	}
+	return filter, true
+}
+
+// lastAuditId returns the id of the newest audit entry, so that a watcher
+// gets only what happens after it connects.
+func lastAuditId() (string, error) {
+	messages, err := watchClient.XRevRangeN(auditStreamKey, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		return "0-0", nil
+	}
+	return messages[0].ID, nil
+}
+
+func writeWatchEvent(w http.ResponseWriter, event *stockEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+func stillAuthorized(token string) bool {
+	request := &pb.ValidateRequest{Token: token}
+	reply, err := authClient.ValidateToken(context.Background(), request)
+	return err == nil && reply.Success
+}
+
+// watchStocks streams changes of stocks as server-sent events. Events are
+// the ones published to stocksExchange and carry audit stream ids, so a
+// client reconnecting with Last-Event-ID misses nothing.
+func watchStocks(w http.ResponseWriter, r *http.Request) {
+	// EventSource in browsers can not set headers
+	if r.Header.Get("access_token") == "" {
+		r.Header.Set("access_token", r.URL.Query().Get("access_token"))
+	}
+	if !validateAndAnswer(false, w, r.Header) {
+		return
+	}
+	token := r.Header.Get("access_token")
+
+	// who changed what, and what it was before, is for admins only, as in
+	// the audit log
+	admin, err := isAdmin(r.Header)
+	if err != nil {
+		util.ErrorAsJson(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filter, ok := parseWatchFilter(w, r)
+	if !ok {
+		return
+	}
+
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("last_event_id")
+	}
+	if lastId != "" {
+		if _, err := nextStreamId(lastId); err != nil {
+			util.ErrorAsJson(w, "Bad last event id", http.StatusBadRequest)
+			return
+		}
+	} else {
+		var err error
+		lastId, err = lastAuditId()
+		if err != nil {
+			util.ErrorAsJson(w, "Failed to get from audit database", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.ErrorAsJson(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case watchers <- struct{}{}:
+		defer func() { <-watchers }()
+	default:
+		util.ErrorAsJson(w, "Too many watchers, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	validatedAt := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		if time.Since(validatedAt) >= watchRevalidateInterval {
+			if !stillAuthorized(token) {
+				_, _ = fmt.Fprint(w, "event: unauthorized\ndata: {\"error\":\"Access denied\"}\n\n")
+				flusher.Flush()
+				return
+			}
+			validatedAt = time.Now()
+		}
+
+		streams, err := watchClient.XRead(&redis.XReadArgs{
+			Streams: []string{auditStreamKey, lastId},
+			Count:   watchBatchSize,
+			Block:   watchBlock,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			// comments keep proxies from closing an idle connection
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			continue
+		} else if err != nil {
+			return
+		}
+
+		for _, stream := range streams {
+			for _, message := range stream.Messages {
+				lastId = message.ID
+				event, err := newStockEvent(parseAuditEntry(message))
+				if err != nil || !filter.matches(event) {
+					continue
+				}
+				if !admin {
+					event.Actor, event.Before = "", nil
+					event.Categories = event.categories()
+				}
+				err = writeWatchEvent(w, event)
+				if err != nil {
+					return
+				}
+			}
+		}
+		flusher.Flush()
+	}
+}